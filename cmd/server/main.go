@@ -5,8 +5,11 @@ import (
 	"go-bot/internal/api"
 	"go-bot/internal/config"
 	"go-bot/internal/db"
+	"go-bot/internal/ratelimit"
+	"go-bot/internal/service"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -42,19 +45,70 @@ func init() {
 	log.Debug().Str("mongo_uri", cfg.MongoURI).Msg("Config loaded")
 
 	log.Debug().Msg("Validating environment variables...")
-	validateEnvVars([]string{"MONGO_URI", "OPENAI_API_KEY"})
+	if cfg.StorageBackend == "mongo" {
+		validateEnvVars([]string{"MONGO_URI"})
+	}
 	log.Debug().Msg("Environment variables validated")
 
 	// initialize db connection with error handling
-	log.Debug().Msg("Attempting MongoDB connection...")
-	if err := db.Connect(cfg.MongoURI); err != nil {
-		log.Fatal().Err(err).Msg("failed to connect to MongoDB")
+	log.Debug().Str("backend", cfg.StorageBackend).Msg("Opening chat store...")
+	store, err := db.NewStore(cfg.StorageBackend, cfg.MongoURI, cfg.SQLitePath, cfg.PostgresDSN)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open chat store")
+	}
+	service.SetStore(store)
+	log.Debug().Msg("Chat store opened successfully")
+
+	// initialize the LLM providers selected in the config
+	log.Debug().Strs("providers", cfg.LLMProviders).Msg("Initializing LLM providers...")
+	if err := service.InitProvider(cfg); err != nil {
+		log.Fatal().Err(err).Msg("failed to initialize LLM provider")
 	}
-	log.Debug().Msg("MongoDB connected successfully")
+	service.ConfigureContextWindow(cfg.HistoryFetchLimit, cfg.CompletionReserveTokens)
+	service.ConfigureGeneration(cfg.LLMMaxOutputTokens)
+	service.ConfigurePricing(cfg.ModelPrices)
+	service.ConfigureQuotas(cfg.UserQuota, cfg.KeyQuota, cfg.QuotaSoftLimitPercent)
+	service.ConfigureStreamResume(time.Duration(cfg.StreamResumeWindowSeconds) * time.Second)
+	service.ConfigureRetries(
+		cfg.LLMMaxRetries,
+		time.Duration(cfg.LLMRetryBaseDelayMs)*time.Millisecond,
+		time.Duration(cfg.LLMRetryMaxDelayMs)*time.Millisecond,
+	)
+
+	// rate limits are shared by every instance with the mongo backend, each instance counts on its own in memory
+	switch cfg.RateLimitBackend {
+	case "off":
+		log.Debug().Msg("Rate limiting disabled")
+	case "memory", "mongo":
+		var backend ratelimit.Backend = ratelimit.NewMemoryBackend()
+		if cfg.RateLimitBackend == "mongo" {
+			mongoBackend, err := ratelimit.NewMongoBackend(cfg.MongoURI)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to open rate limit backend")
+			}
+			backend = mongoBackend
+		}
+		api.SetRateLimiter(ratelimit.NewLimiter(backend, ratelimit.Rules{
+			Window:  time.Duration(cfg.RateLimitWindowSeconds) * time.Second,
+			PerKey:  cfg.RateLimitPerKey,
+			PerUser: cfg.RateLimitPerUser,
+			PerIP:   cfg.RateLimitPerIP,
+		}))
+		log.Debug().Str("backend", cfg.RateLimitBackend).Msg("Rate limiting enabled")
+	default:
+		log.Fatal().Str("backend", cfg.RateLimitBackend).Msg("unknown rate limit backend")
+	}
+
+	api.ConfigureWebSocket(cfg.WSAllowedOrigins, time.Duration(cfg.WSPingIntervalSeconds)*time.Second)
 
 	// initialize Gin router
 	log.Debug().Msg("Initializing Gin router...")
 	router := gin.Default()
+	// client IPs are taken from X-Forwarded-For only when set by these proxies, anyone else could pose as any
+	// address, e.g. to get a fresh per-IP rate limit with every request
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal().Err(err).Msg("invalid TRUSTED_PROXIES")
+	}
 	api.RegisterRoutes(router)
 	router.Use(errorHandlingMiddleware())
 	log.Debug().Msg("Router initialized")
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+	"go-bot/internal/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// spend per user, API key or model over a period, the current month by default
+func handleUsageReport(c *gin.Context) {
+	now := time.Now().UTC()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	to := now
+
+	var ok bool
+	if raw := c.Query("from"); raw != "" {
+		if from, ok = parseReportTime(raw, false); !ok {
+			util.RespondWithError(c, http.StatusBadRequest, "from must be a date (YYYY-MM-DD) or an RFC 3339 time")
+			return
+		}
+	}
+	if raw := c.Query("to"); raw != "" {
+		if to, ok = parseReportTime(raw, true); !ok {
+			util.RespondWithError(c, http.StatusBadRequest, "to must be a date (YYYY-MM-DD) or an RFC 3339 time")
+			return
+		}
+	}
+	if !from.Before(to) {
+		util.RespondWithError(c, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	groupBy := c.DefaultQuery("group_by", models.UsageGroupUser)
+	switch groupBy {
+	case models.UsageGroupUser, models.UsageGroupKey, models.UsageGroupModel:
+	default:
+		util.RespondWithError(c, http.StatusBadRequest, "group_by must be user, key or model")
+		return
+	}
+
+	usage, err := service.UsageReport(c.Request.Context(), from, to, groupBy)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to build usage report")
+		util.RespondWithError(c, http.StatusInternalServerError, "Failed to build usage report")
+		return
+	}
+
+	total := models.UsageTotal{}
+	for _, group := range usage {
+		total.Messages += group.Messages
+		total.PromptTokens += group.PromptTokens
+		total.CompletionTokens += group.CompletionTokens
+		total.TotalTokens += group.TotalTokens
+		total.Cost += group.Cost
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":     from,
+		"to":       to,
+		"group_by": groupBy,
+		"currency": "USD",
+		"usage":    usage,
+		"total":    total,
+	})
+}
+
+// parse a report bound, a date alone covers the whole UTC day so "to" includes it
+func parseReportTime(raw string, end bool) (time.Time, bool) {
+	if day, err := time.Parse(time.DateOnly, raw); err == nil {
+		if end {
+			day = day.AddDate(0, 0, 1)
+		}
+		return day, true
+	}
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return parsed.UTC(), true
+}
+
+// create a managed API key, the key itself is only part of this response
+func handleCreateAPIKey(c *gin.Context) {
+	var request models.APIKeyRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		util.RespondWithError(c, http.StatusBadRequest, "Invalid API key request payload")
+		return
+	}
+
+	key, plaintext, err := service.CreateAPIKey(c.Request.Context(), request)
+	if errors.Is(err, service.ErrInvalidAPIKeyRequest) {
+		util.RespondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create API key")
+		util.RespondWithError(c, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"key": plaintext, "api_key": key})
+}
+
+func handleListAPIKeys(c *gin.Context) {
+	keys, err := service.ListAPIKeys(c.Request.Context())
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list API keys")
+		util.RespondWithError(c, http.StatusInternalServerError, "Failed to list API keys")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// revoke a managed API key, the record is kept for usage reports
+func handleRevokeAPIKey(c *gin.Context) {
+	key, err := service.RevokeAPIKey(c.Request.Context(), c.Param("id"))
+	if errors.Is(err, db.ErrAPIKeyNotFound) {
+		util.RespondWithError(c, http.StatusNotFound, "API key not found")
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to revoke API key")
+		util.RespondWithError(c, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key": key})
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// respond with an error body OpenAI SDKs understand
+func respondWithCompletionError(c *gin.Context, code int, message, errorType string) {
+	c.AbortWithStatusJSON(code, models.CompletionError{
+		Error: models.CompletionErrorDetail{Message: message, Type: errorType},
+	})
+}
+
+// translate OpenAI messages to provider messages, developer turns are treated as system turns
+func completionMessages(messages []models.CompletionMessage) ([]service.Message, error) {
+	converted := make([]service.Message, 0, len(messages))
+	for _, message := range messages {
+		role := message.Role
+		switch role {
+		case "developer":
+			role = "system"
+		case "system", "user", "assistant":
+		default:
+			return nil, errors.New("unsupported message role: " + message.Role)
+		}
+		converted = append(converted, service.Message{Role: role, Content: string(message.Content)})
+	}
+	return converted, nil
+}
+
+// OpenAI-compatible chat completions, the conversation comes from the client and the exchange is saved like any other chat.
+// X-Conversation-ID selects the conversation it is saved in, a new one is started when it is missing.
+func handleChatCompletions(c *gin.Context) {
+	var completionRequest models.CompletionRequest
+	if err := c.ShouldBindJSON(&completionRequest); err != nil {
+		log.Error().Err(err).Msg("Invalid chat completion payload")
+		respondWithCompletionError(c, http.StatusBadRequest, "Invalid chat completion payload: "+err.Error(), "invalid_request_error")
+		return
+	}
+	if len(completionRequest.Messages) == 0 {
+		respondWithCompletionError(c, http.StatusBadRequest, "messages cannot be empty", "invalid_request_error")
+		return
+	}
+
+	messages, err := completionMessages(completionRequest.Messages)
+	if err != nil {
+		respondWithCompletionError(c, http.StatusBadRequest, err.Error(), "invalid_request_error")
+		return
+	}
+
+	chatRequest := models.ChatRequest{
+		UserID:           strings.TrimSpace(completionRequest.User),
+		ConversationID:   strings.TrimSpace(c.GetHeader("X-Conversation-ID")),
+		GenerationParams: completionRequest.GenerationParams,
+	}
+	if chatRequest.MaxTokens == nil {
+		chatRequest.MaxTokens = completionRequest.MaxCompletionTokens
+	}
+	// an unknown model is refused like OpenAI does, rather than answered by another one
+	if completionRequest.Model != "" {
+		if !service.AllowedModel(completionRequest.Model) {
+			code := "model_not_found"
+			c.AbortWithStatusJSON(http.StatusBadRequest, models.CompletionError{
+				Error: models.CompletionErrorDetail{
+					Message: "The model `" + completionRequest.Model + "` does not exist or you do not have access to it.",
+					Type:    "invalid_request_error",
+					Code:    &code,
+				},
+			})
+			return
+		}
+		chatRequest.Model = completionRequest.Model
+	}
+
+	if completionRequest.Stream {
+		if !hasScope(c, models.APIKeyScopeStream) {
+			respondWithCompletionError(c, http.StatusForbidden, "API key not allowed to stream", "invalid_request_error")
+			return
+		}
+		streamCompletion(c, &chatRequest, messages, completionRequest.StreamOptions)
+		return
+	}
+
+	if !hasScope(c, models.APIKeyScopeChat) {
+		respondWithCompletionError(c, http.StatusForbidden, "API key not allowed to chat", "invalid_request_error")
+		return
+	}
+	result, err := service.ProcessCompletion(c.Request.Context(), &chatRequest, messages)
+	setQuotaHeaders(c, chatRequest.Quota)
+	if err != nil {
+		respondWithCompletionFailure(c, err)
+		return
+	}
+
+	c.Header("X-User-ID", chatRequest.UserID)
+	c.Header("X-Conversation-ID", chatRequest.ConversationID)
+	c.JSON(http.StatusOK, models.CompletionResponse{
+		ID:      "chatcmpl-" + result.MessageID,
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   result.Model,
+		Choices: []models.CompletionChoice{{
+			Message:      &models.CompletionMessage{Role: "assistant", Content: models.CompletionContent(result.Response)},
+			FinishReason: completionFinishReason(result.FinishReason),
+		}},
+		Usage: &result.Usage,
+	})
+}
+
+// answer a failed completion in the OpenAI error format, see serviceErrorResponse
+func respondWithCompletionFailure(c *gin.Context, err error) {
+	status, message, code := serviceErrorResponse(err, "Failed to process chat completion")
+	detail := models.CompletionErrorDetail{Message: message, Type: completionErrorType(status)}
+	if code != "" {
+		detail.Code = &code
+	}
+	c.AbortWithStatusJSON(status, models.CompletionError{Error: detail})
+}
+
+// OpenAI error type matching a status, SDKs pick their exception class from the status
+func completionErrorType(status int) string {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case status < http.StatusInternalServerError:
+		return "invalid_request_error"
+	default:
+		return "server_error"
+	}
+}
+
+// finish reason OpenAI SDKs know, an answer cancelled on our side ends like one stopped by a stop sequence
+func completionFinishReason(finishReason string) *string {
+	if finishReason == "cancelled" {
+		finishReason = "stop"
+	}
+	return &finishReason
+}
+
+// stream the answer as chat.completion.chunk events terminated by [DONE]
+func streamCompletion(c *gin.Context, chatRequest *models.ChatRequest, messages []service.Message, options *models.StreamOptions) {
+	streamChannel, err := service.ProcessCompletionStream(c.Request.Context(), chatRequest, messages)
+	setQuotaHeaders(c, chatRequest.Quota)
+	if err != nil {
+		respondWithCompletionFailure(c, err)
+		return
+	}
+
+	c.Header("X-User-ID", chatRequest.UserID)
+	c.Header("X-Conversation-ID", chatRequest.ConversationID)
+
+	includeUsage := options != nil && options.IncludeUsage
+	chunk := models.CompletionResponse{
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+	}
+	// OpenAI sends usage after the finish reason, while our usage event comes before done
+	var usage *models.Usage
+
+	c.Stream(func(w io.Writer) bool {
+		event, ok := <-streamChannel
+		if !ok {
+			c.Render(-1, sse.Event{Data: "[DONE]"})
+			return false
+		}
+
+		switch event.Type {
+		case models.StreamEventStart:
+			chunk.ID = "chatcmpl-" + event.MessageID
+			chunk.Model = event.Model
+			chunk.Choices = []models.CompletionChoice{{Delta: &models.CompletionDelta{Role: "assistant"}}}
+		case models.StreamEventDelta:
+			chunk.Choices = []models.CompletionChoice{{Delta: &models.CompletionDelta{Content: event.Text}}}
+		case models.StreamEventUsage:
+			usage = event.Usage
+			return true
+		case models.StreamEventError:
+			detail := models.CompletionErrorDetail{Message: event.Error, Type: "server_error"}
+			if event.Code != "" {
+				detail.Code = &event.Code
+			}
+			c.Render(-1, sse.Event{Data: models.CompletionError{Error: detail}})
+			return true
+		case models.StreamEventDone:
+			// a failed stream was already reported by its error chunk and gets no finish reason
+			if event.FinishReason == "error" {
+				return true
+			}
+			chunk.Choices = []models.CompletionChoice{{Delta: &models.CompletionDelta{}, FinishReason: completionFinishReason(event.FinishReason)}}
+			c.Render(-1, sse.Event{Data: chunk})
+
+			if includeUsage && usage != nil {
+				// the usage chunk has no choices
+				chunk.Choices = []models.CompletionChoice{}
+				chunk.Usage = usage
+				c.Render(-1, sse.Event{Data: chunk})
+			}
+			return true
+		default:
+			return true
+		}
+
+		c.Render(-1, sse.Event{Data: chunk})
+		return true
+	})
+}
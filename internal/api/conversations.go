@@ -0,0 +1,133 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+	"go-bot/internal/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultMessagesLimit = 50
+	maxMessagesLimit     = 500
+)
+
+// read the user owning the conversations from the query string
+func requireUserID(c *gin.Context) (string, bool) {
+	userID := strings.TrimSpace(c.Query("user_id"))
+	if userID == "" {
+		util.RespondWithError(c, http.StatusBadRequest, "user_id is required")
+		return "", false
+	}
+	return userID, true
+}
+
+// respond to a failed conversation lookup or change
+func respondWithConversationError(c *gin.Context, err error, message string) {
+	if errors.Is(err, db.ErrConversationNotFound) {
+		util.RespondWithError(c, http.StatusNotFound, "Conversation not found")
+		return
+	}
+	log.Error().Err(err).Msg(message)
+	util.RespondWithError(c, http.StatusInternalServerError, message)
+}
+
+func handleListConversations(c *gin.Context) {
+	userID, ok := requireUserID(c)
+	if !ok {
+		return
+	}
+
+	includeArchived := c.Query("include_archived") == "true"
+	conversations, err := service.ListConversations(c.Request.Context(), userID, includeArchived)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list conversations")
+		util.RespondWithError(c, http.StatusInternalServerError, "Failed to list conversations")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversations": conversations})
+}
+
+func handleConversationMessages(c *gin.Context) {
+	userID, ok := requireUserID(c)
+	if !ok {
+		return
+	}
+
+	limit := defaultMessagesLimit
+	if raw := c.Query("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 || parsed > maxMessagesLimit {
+			util.RespondWithError(c, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxMessagesLimit))
+			return
+		}
+		limit = parsed
+	}
+
+	conversation, messages, err := service.GetConversationMessages(c.Request.Context(), userID, c.Param("id"), limit)
+	if err != nil {
+		respondWithConversationError(c, err, "Failed to load conversation messages")
+		return
+	}
+	if messages == nil {
+		messages = []models.ChatMessage{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"conversation": conversation,
+		"messages":     messages,
+	})
+}
+
+func handleUpdateConversation(c *gin.Context) {
+	userID, ok := requireUserID(c)
+	if !ok {
+		return
+	}
+
+	var update models.ConversationUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		log.Error().Err(err).Msg("Invalid conversation update payload")
+		util.RespondWithError(c, http.StatusBadRequest, "Invalid conversation update payload")
+		return
+	}
+	if update.Title == nil && update.Archived == nil {
+		util.RespondWithError(c, http.StatusBadRequest, "Nothing to update")
+		return
+	}
+	if update.Title != nil && strings.TrimSpace(*update.Title) == "" {
+		util.RespondWithError(c, http.StatusBadRequest, "Title cannot be empty")
+		return
+	}
+
+	conversation, err := service.UpdateConversation(c.Request.Context(), userID, c.Param("id"), update)
+	if err != nil {
+		respondWithConversationError(c, err, "Failed to update conversation")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversation": conversation})
+}
+
+func handleDeleteConversation(c *gin.Context) {
+	userID, ok := requireUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := service.DeleteConversation(c.Request.Context(), userID, c.Param("id")); err != nil {
+		respondWithConversationError(c, err, "Failed to delete conversation")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
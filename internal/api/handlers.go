@@ -1,14 +1,18 @@
 package api
 
 import (
+	"errors"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"go-bot/internal/db"
 	"go-bot/internal/models"
 	"go-bot/internal/service"
 	"go-bot/internal/util"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 )
@@ -29,14 +33,51 @@ func handleChat(c *gin.Context) {
 	}
 
 	// centralized OpenAI request logic
-	response, err := service.ProcessChat(chatRequest)
+	response, err := service.ProcessChat(c.Request.Context(), &chatRequest)
+	setQuotaHeaders(c, chatRequest.Quota)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to process chat request")
-		util.RespondWithError(c, http.StatusInternalServerError, "Failed to process chat request")
+		respondServiceError(c, err, "Failed to process chat request")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"response": response})
+	c.JSON(http.StatusOK, gin.H{
+		"response":        response,
+		"user_id":         chatRequest.UserID,
+		"conversation_id": chatRequest.ConversationID,
+	})
+}
+
+// status, message and error code (empty when there is none) a failure of the chat service is answered with.
+// Unexpected failures are logged and answered with message, their details are not for the client.
+func serviceErrorResponse(err error, message string) (int, string, string) {
+	var (
+		quotaErr *service.QuotaExceededError
+		httpErr  util.HTTPError
+	)
+	switch {
+	case errors.Is(err, db.ErrConversationNotFound):
+		return http.StatusNotFound, "Conversation not found", ""
+	case errors.Is(err, service.ErrInvalidParameters), errors.Is(err, service.ErrUserRequired), errors.Is(err, service.ErrNoUserMessage):
+		return http.StatusBadRequest, err.Error(), ""
+	case errors.As(err, &quotaErr):
+		return quotaErr.HTTPStatus(), quotaErr.Error(), quotaErr.ErrorCode()
+	}
+
+	log.Error().Err(err).Msg(message)
+	if errors.As(err, &httpErr) {
+		return httpErr.HTTPStatus(), message, httpErr.ErrorCode()
+	}
+	return http.StatusInternalServerError, message, ""
+}
+
+// answer a failed chat or stream request, see serviceErrorResponse
+func respondServiceError(c *gin.Context, err error, message string) {
+	status, message, code := serviceErrorResponse(err, message)
+	if code == "" {
+		util.RespondWithError(c, status, message)
+		return
+	}
+	c.JSON(status, gin.H{"error": message, "code": code})
 }
 
 func handleStream(c *gin.Context) {
@@ -54,10 +95,10 @@ func handleStream(c *gin.Context) {
 		return
 	}
 
-	streamChannel, err := service.ProcessStream(chatRequest)
+	streamChannel, err := service.ProcessStream(c.Request.Context(), &chatRequest)
+	setQuotaHeaders(c, chatRequest.Quota)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to process streaming request")
-		util.RespondWithError(c, http.StatusInternalServerError, "Streaming failed")
+		respondServiceError(c, err, "Streaming failed")
 		return
 	}
 
@@ -68,23 +109,77 @@ func handleStream(c *gin.Context) {
 		return
 	}
 
-	// stream response
-	c.Stream(func(w io.Writer) bool {
-		for msg := range streamChannel {
-			cleanMsg := strings.TrimSpace(msg)
+	// let the client continue the conversation on its next request
+	c.Header("X-User-ID", chatRequest.UserID)
+	c.Header("X-Conversation-ID", chatRequest.ConversationID)
 
-			// ignore "[DONE]" token
-			if cleanMsg == "[DONE]" {
-				log.Debug().Msg("Received [DONE] token, closing stream")
-				return false
-			}
+	streamEvents(c, streamChannel)
+}
 
-			log.Debug().Str("streamed_message", cleanMsg).Msg("Streaming message to client")
-			c.SSEvent("message", cleanMsg)
+// resume a stream after a dropped connection, replaying the events after Last-Event-ID before following it live
+func handleResumeStream(c *gin.Context) {
+	userID, ok := requireUserID(c)
+	if !ok {
+		return
+	}
+
+	// EventSource sends the header on reconnects, the query parameter serves clients unable to set headers
+	rawLastEventID := c.GetHeader("Last-Event-ID")
+	if rawLastEventID == "" {
+		rawLastEventID = c.Query("last_event_id")
+	}
+	lastEventID := 0
+	if rawLastEventID != "" {
+		parsed, err := strconv.Atoi(rawLastEventID)
+		if err != nil || parsed < 0 {
+			util.RespondWithError(c, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+		lastEventID = parsed
+	}
+
+	streamChannel, err := service.ResumeStream(c.Request.Context(), userID, c.Param("id"), lastEventID)
+	if errors.Is(err, service.ErrStreamNotFound) {
+		util.RespondWithError(c, http.StatusNotFound, "Stream not found or expired")
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to resume stream")
+		util.RespondWithError(c, http.StatusInternalServerError, "Failed to resume stream")
+		return
+	}
+
+	streamEvents(c, streamChannel)
+}
+
+// issue a single-use ticket that authenticates one /ws or /stream/:id connection as the request's API key,
+// for browsers whose WebSocket and EventSource cannot send the key in a header
+func handleIssueStreamTicket(c *gin.Context) {
+	ticket, expiresAt, err := service.IssueStreamTicket(util.APIKeyID(c.Request.Context()))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to issue stream ticket")
+		util.RespondWithError(c, http.StatusInternalServerError, "Failed to issue stream ticket")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ticket": ticket, "expires_at": expiresAt.UTC()})
+}
+
+// write typed events as JSON server-sent events, each one is flushed as soon as it is written
+func streamEvents(c *gin.Context, streamChannel <-chan models.StreamEvent) {
+	c.Stream(func(w io.Writer) bool {
+		event, ok := <-streamChannel
+		if !ok {
+			return false
 		}
 
-		c.SSEvent("done", "Stream completed")
-		return false
+		log.Debug().Str("event", event.Type).Int("id", event.ID).Msg("Streaming event to client")
+		c.Render(-1, sse.Event{
+			Id:    strconv.Itoa(event.ID),
+			Event: event.Type,
+			Data:  event,
+		})
+		return true
 	})
 }
 
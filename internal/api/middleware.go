@@ -1,43 +1,198 @@
 package api
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"go-bot/internal/models"
+	"go-bot/internal/ratelimit"
+	"go-bot/internal/service"
 	"go-bot/internal/util"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
-// validate the API key from the request header
-func APIKeyMiddleware() gin.HandlerFunc {
-	apiKey := os.Getenv("API_KEY") // load API key from environment variables
+// gin context key of the scopes granted to the request's API key
+const apiKeyScopesKey = "api_key_scopes"
+
+// routes browsers open with WebSocket and EventSource, which cannot send headers, so a stream ticket
+// in the ticket query parameter is accepted instead of a key
+var ticketRoutes = []string{"/ws", "/stream/:id"}
+
+// a key configured in the environment rather than managed in the database
+type environmentKey struct {
+	hash   string
+	id     string
+	scopes []string
+}
 
-	if apiKey == "" {
-		log.Fatal().Msg("API_KEY not set in environment variables. Shutting down.")
-		os.Exit(1)
+// authenticate the key sent in the X-API-KEY header or as an Authorization bearer token. Besides the keys managed
+// through the admin API, API_KEY grants chat and stream and ADMIN_API_KEY grants admin when they are set.
+// Keys are only ever compared by hash and in constant time, and never logged.
+func APIKeyMiddleware() gin.HandlerFunc {
+	var environmentKeys []environmentKey
+	if apiKey := os.Getenv("API_KEY"); apiKey != "" {
+		environmentKeys = append(environmentKeys, environmentKey{
+			hash:   service.HashAPIKey(apiKey),
+			id:     apiKeyID(apiKey),
+			scopes: []string{models.APIKeyScopeChat, models.APIKeyScopeStream},
+		})
+	}
+	if adminKey := os.Getenv("ADMIN_API_KEY"); adminKey != "" {
+		environmentKeys = append(environmentKeys, environmentKey{
+			hash:   service.HashAPIKey(adminKey),
+			id:     apiKeyID(adminKey),
+			scopes: []string{models.APIKeyScopeAdmin},
+		})
 	}
 
 	return func(c *gin.Context) {
-		clientKey := c.GetHeader("X-API-KEY")
-
-		// validate the API key
-		if clientKey != apiKey {
-			log.Warn().
-				Str("client_ip", c.ClientIP()).
-				Str("received_key", clientKey).
-				Msg("unauthorized access attempt")
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			c.Abort()
+		clientKey := requestAPIKey(c)
+		if clientKey == "" {
+			if ticket := c.Query("ticket"); ticket != "" && slices.Contains(ticketRoutes, c.FullPath()) {
+				authenticateTicket(c, ticket)
+				return
+			}
+			rejectUnauthorized(c)
 			return
 		}
 
+		var (
+			keyID  string
+			scopes []string
+		)
+		// every environment key is compared so the time taken does not tell which one nearly matched
+		hash := service.HashAPIKey(clientKey)
+		for _, key := range environmentKeys {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(key.hash)) == 1 {
+				keyID, scopes = key.id, key.scopes
+			}
+		}
+
+		if keyID == "" {
+			key, err := service.AuthenticateAPIKey(c.Request.Context(), clientKey)
+			if errors.Is(err, service.ErrUnauthorized) {
+				rejectUnauthorized(c)
+				return
+			}
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to verify API key")
+				util.RespondWithError(c, http.StatusInternalServerError, "Failed to verify API key")
+				c.Abort()
+				return
+			}
+			keyID, scopes = key.ID.Hex(), key.Scopes
+		}
+
 		log.Debug().
 			Str("client_ip", c.ClientIP()).
+			Str("key_id", keyID).
 			Msg("api key validated successfully")
 
+		// usage and spend are attributed to the key without storing the key itself
+		c.Set(apiKeyScopesKey, scopes)
+		c.Request = c.Request.WithContext(util.WithAPIKeyID(c.Request.Context(), keyID))
+
+		c.Next()
+	}
+}
+
+// authenticate a request by a stream ticket, which grants the stream scope of the key it was issued to
+func authenticateTicket(c *gin.Context, ticket string) {
+	keyID, err := service.RedeemStreamTicket(ticket)
+	if err != nil {
+		rejectUnauthorized(c)
+		return
+	}
+
+	log.Debug().
+		Str("client_ip", c.ClientIP()).
+		Str("key_id", keyID).
+		Msg("stream ticket redeemed")
+
+	c.Set(apiKeyScopesKey, []string{models.APIKeyScopeStream})
+	c.Request = c.Request.WithContext(util.WithAPIKeyID(c.Request.Context(), keyID))
+	c.Next()
+}
+
+func rejectUnauthorized(c *gin.Context) {
+	log.Warn().
+		Str("client_ip", c.ClientIP()).
+		Msg("unauthorized access attempt")
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	c.Abort()
+}
+
+// only let requests through whose API key was granted one of the scopes, runs after APIKeyMiddleware
+func RequireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, scope := range scopes {
+			if hasScope(c, scope) {
+				c.Next()
+				return
+			}
+		}
+		log.Warn().
+			Str("client_ip", c.ClientIP()).
+			Str("key_id", util.APIKeyID(c.Request.Context())).
+			Strs("required", scopes).
+			Msg("API key lacks the scope of the request")
+		util.RespondWithError(c, http.StatusForbidden, "API key not allowed to "+strings.Join(scopes, " or "))
+		c.Abort()
+	}
+}
+
+// whether the request's API key was granted scope
+func hasScope(c *gin.Context, scope string) bool {
+	return slices.Contains(c.GetStringSlice(apiKeyScopesKey), scope)
+}
+
+// the key a client sent in the X-API-KEY header, or as a bearer token like OpenAI SDKs do
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-KEY"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+}
+
+// stable, non-secret identifier of an environment key for usage reports, managed keys are identified by their ID
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key_" + hex.EncodeToString(sum[:])[:12]
+}
+
+// attach the request ID and tenant to the request context so they reach the store and LLM calls,
+// a request ID is generated when the client does not send one
+func RequestContextMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+		c.Header("X-Request-ID", requestID)
+
+		ctx := util.WithRequestID(c.Request.Context(), requestID)
+		if tenant := c.GetHeader("X-Tenant-ID"); tenant != "" {
+			ctx = util.WithTenant(ctx, tenant)
+		}
+		c.Request = c.Request.WithContext(ctx)
+
 		c.Next()
 	}
 }
@@ -58,3 +213,137 @@ func RequestLoggerMiddleware() gin.HandlerFunc {
 		util.LogRequestOrResponse(c, duration, true)
 	}
 }
+
+var (
+	rateLimiter      *ratelimit.Limiter
+	rateLimiterMutex sync.RWMutex
+)
+
+// replace the limiter applied to protected routes, nil turns rate limiting off
+func SetRateLimiter(limiter *ratelimit.Limiter) {
+	rateLimiterMutex.Lock()
+	defer rateLimiterMutex.Unlock()
+	rateLimiter = limiter
+}
+
+// the tightest rate limit result of the request so far, reported in the RateLimit-* headers
+const rateLimitResultKey = "rate_limit_result"
+
+// limit the requests of every client IP. Runs before APIKeyMiddleware so requests with missing or invalid
+// keys are counted as well.
+func ClientRateLimitMiddleware() gin.HandlerFunc {
+	return rateLimitMiddleware(func(c *gin.Context) ratelimit.Subject {
+		return ratelimit.Subject{IP: c.ClientIP()}
+	})
+}
+
+// limit the requests of every API key and user. Runs after APIKeyMiddleware so requests are counted against
+// their key.
+func RateLimitMiddleware() gin.HandlerFunc {
+	return rateLimitMiddleware(func(c *gin.Context) ratelimit.Subject {
+		return ratelimit.Subject{
+			KeyID:  util.APIKeyID(c.Request.Context()),
+			UserID: requestUserID(c),
+		}
+	})
+}
+
+// count the request against the limits of its subject, reporting the limit closest to being reached
+// in RateLimit-* headers
+func rateLimitMiddleware(subject func(c *gin.Context) ratelimit.Subject) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rateLimiterMutex.RLock()
+		limiter := rateLimiter
+		rateLimiterMutex.RUnlock()
+		if limiter == nil {
+			c.Next()
+			return
+		}
+
+		result, err := limiter.Allow(c.Request.Context(), subject(c))
+		if err != nil || result == nil {
+			c.Next()
+			return
+		}
+		// an earlier limit of the request may still be the closest one
+		if earlier, ok := c.Get(rateLimitResultKey); ok && !result.Tighter(earlier.(ratelimit.Result)) {
+			*result = earlier.(ratelimit.Result)
+		}
+		c.Set(rateLimitResultKey, *result)
+
+		resetSeconds := strconv.Itoa(int(math.Ceil(result.Reset.Seconds())))
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", resetSeconds)
+
+		if !result.Allowed {
+			log.Warn().
+				Str("client_ip", c.ClientIP()).
+				Str("scope", result.Scope).
+				Msg("Rate limit exceeded, request rejected")
+			c.Header("Retry-After", resetSeconds)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "rate limit exceeded", "code": "rate_limit_exceeded"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// how much of a JSON body is read to find the user a request is made for
+const userIDPeekLimit = 64 << 10
+
+// the user a request is made for, from the user_id query parameter or the user_id (user on the OpenAI API)
+// field of a JSON body. Only the first userIDPeekLimit bytes of the body are looked at, and the body is put back
+// for the handler.
+func requestUserID(c *gin.Context) string {
+	if userID := strings.TrimSpace(c.Query("user_id")); userID != "" {
+		return userID
+	}
+	// clients often leave out the content type of JSON bodies, the handlers accept them anyway
+	if contentType := c.ContentType(); c.Request.Body == nil || (contentType != "" && contentType != "application/json") {
+		return ""
+	}
+
+	prefix, err := io.ReadAll(io.LimitReader(c.Request.Body, userIDPeekLimit))
+	c.Request.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), c.Request.Body), c.Request.Body}
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(bodyUserID(prefix))
+}
+
+// the user_id or user field of a JSON object, walked field by field so that it is found in a body cut off
+// after it
+func bodyUserID(body []byte) string {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return ""
+	}
+	var user string
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		var value json.RawMessage
+		if decoder.Decode(&value) != nil {
+			break
+		}
+		var field string
+		switch key {
+		case "user_id":
+			if json.Unmarshal(value, &field) == nil && field != "" {
+				return field
+			}
+		case "user":
+			if json.Unmarshal(value, &field) == nil {
+				user = cmp.Or(user, field)
+			}
+		}
+	}
+	return user
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"go-bot/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// report the standing against the quota closest to its limit, with a warning past the soft limit
+// and a Retry-After once it is used up
+func setQuotaHeaders(c *gin.Context, status *models.QuotaStatus) {
+	if status == nil {
+		return
+	}
+
+	resetSeconds := int(math.Ceil(time.Until(status.Reset).Seconds()))
+	c.Header("X-Quota-Scope", status.Scope)
+	c.Header("X-Quota-Period", status.Period)
+	c.Header("X-Quota-Unit", status.Unit)
+	c.Header("X-Quota-Limit", formatQuota(status.Unit, status.Limit))
+	c.Header("X-Quota-Remaining", formatQuota(status.Unit, status.Remaining()))
+	c.Header("X-Quota-Reset", strconv.Itoa(resetSeconds))
+
+	switch {
+	case status.Exceeded():
+		c.Header("Retry-After", strconv.Itoa(resetSeconds))
+	case status.Warning:
+		c.Header("X-Quota-Warning", fmt.Sprintf("%.0f%% of the %s used", 100*status.Used/status.Limit, status.Describe()))
+	}
+}
+
+// tokens are whole numbers, spend is given to the hundredth of a cent
+func formatQuota(unit string, value float64) string {
+	if unit == models.QuotaUnitTokens {
+		return strconv.FormatInt(int64(value), 10)
+	}
+	return strconv.FormatFloat(value, 'f', 4, 64)
+}
@@ -3,6 +3,8 @@ package api
 import (
 	"time"
 
+	"go-bot/internal/models"
+
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -12,21 +14,51 @@ func RegisterRoutes(router *gin.Engine) {
 	// setup CORS - keeping your original configuration
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:  []string{"*"}, // Keep allowing all for development
-		AllowMethods:  []string{"POST", "GET", "OPTIONS"},
-		AllowHeaders:  []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-API-KEY"},
-		ExposeHeaders: []string{"Content-Length"},
+		AllowMethods:  []string{"POST", "GET", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:  []string{"Origin", "Content-Length", "Content-Type", "Authorization", "X-API-KEY", "X-Request-ID", "X-Tenant-ID", "Last-Event-ID", "X-Conversation-ID"},
+		ExposeHeaders: []string{"Content-Length", "X-User-ID", "X-Conversation-ID", "X-Request-ID", "Retry-After", "X-Quota-Scope", "X-Quota-Period", "X-Quota-Unit", "X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset", "X-Quota-Warning", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset"},
 		MaxAge:        12 * time.Hour,
 	}))
 
+	router.Use(RequestContextMiddleware())
+
 	// health check
 	router.GET("/status", handleStatus)
 
-	// service-level protected routes with middleware
+	// service-level protected routes with middleware, each one needs a key granted its scope
 	protected := router.Group("/")
-	protected.Use(APIKeyMiddleware(), RequestLoggerMiddleware())
+	protected.Use(ClientRateLimitMiddleware(), APIKeyMiddleware(), RateLimitMiddleware(), RequestLoggerMiddleware())
 	{
-		protected.POST("/chat", handleChat)
-		protected.POST("/stream", handleStream)
+		chat := RequireScope(models.APIKeyScopeChat)
+		stream := RequireScope(models.APIKeyScopeStream)
+		either := RequireScope(models.APIKeyScopeChat, models.APIKeyScopeStream)
+
+		protected.POST("/chat", chat, handleChat)
+		protected.POST("/stream", stream, handleStream)
+		protected.GET("/stream/:id", stream, handleResumeStream)
+		protected.GET("/ws", stream, handleWebSocket)
+		// single-use credential for the two routes above, which browsers cannot send keys to
+		protected.POST("/stream/tickets", stream, handleIssueStreamTicket)
+
+		// OpenAI-compatible API, point OpenAI SDKs at <host>/v1. Streamed completions need the stream scope.
+		protected.POST("/v1/chat/completions", either, handleChatCompletions)
+
+		// conversation management
+		protected.GET("/conversations", either, handleListConversations)
+		protected.GET("/conversations/:id/messages", either, handleConversationMessages)
+		protected.PATCH("/conversations/:id", either, handleUpdateConversation)
+		protected.DELETE("/conversations/:id", either, handleDeleteConversation)
+	}
+
+	// operator API, for keys granted the admin scope
+	admin := router.Group("/admin")
+	admin.Use(ClientRateLimitMiddleware(), APIKeyMiddleware(), RateLimitMiddleware(), RequireScope(models.APIKeyScopeAdmin), RequestLoggerMiddleware())
+	{
+		admin.GET("/usage", handleUsageReport)
+
+		admin.POST("/keys", handleCreateAPIKey)
+		admin.GET("/keys", handleListAPIKeys)
+		admin.DELETE("/keys/:id", handleRevokeAPIKey)
 	}
 
 	log.Debug().Msg("Routes registered successfully")
@@ -0,0 +1,349 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	wsMaxFrameSize  = 64 * 1024
+	wsWriteTimeout  = 10 * time.Second
+	wsOutgoingQueue = 32
+
+	DefaultWebSocketPingInterval = 30 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkWebSocketOrigin,
+}
+
+var (
+	wsAllowedOrigins []string
+	wsPingInterval   = DefaultWebSocketPingInterval
+	wsConfigMutex    sync.RWMutex
+)
+
+// set the browser origins allowed to open WebSocket connections besides the server's own ("*" allows any),
+// and how often connections are pinged; a peer silent for two intervals is disconnected
+func ConfigureWebSocket(allowedOrigins []string, pingInterval time.Duration) {
+	wsConfigMutex.Lock()
+	defer wsConfigMutex.Unlock()
+	wsAllowedOrigins = nil
+	for _, origin := range allowedOrigins {
+		wsAllowedOrigins = append(wsAllowedOrigins, strings.ToLower(strings.TrimSuffix(origin, "/")))
+	}
+	if pingInterval <= 0 {
+		pingInterval = DefaultWebSocketPingInterval
+	}
+	wsPingInterval = pingInterval
+}
+
+func webSocketPingInterval() time.Duration {
+	wsConfigMutex.RLock()
+	defer wsConfigMutex.RUnlock()
+	return wsPingInterval
+}
+
+// browsers send the page's origin with the handshake, a page of another site may only connect when it is allowed,
+// or it could chat with the credentials the browser holds for this one. Clients sending no origin are not browsers.
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+
+	wsConfigMutex.RLock()
+	allowed := slices.Contains(wsAllowedOrigins, "*") || slices.Contains(wsAllowedOrigins, strings.ToLower(origin))
+	wsConfigMutex.RUnlock()
+	if !allowed {
+		log.Warn().Str("origin", origin).Msg("WebSocket connection from a foreign origin rejected")
+	}
+	return allowed
+}
+
+// wsSession is the state of one WebSocket connection, frames are read by the handler goroutine
+// and written by a single writer goroutine fed through outgoing
+type wsSession struct {
+	conn         *websocket.Conn
+	ctx          context.Context
+	outgoing     chan models.StreamEvent
+	pingInterval time.Duration
+
+	mutex          sync.Mutex
+	userID         string
+	conversationID string
+	turn           *wsTurn // answer being generated, nil when idle
+}
+
+// wsTurn is an answer being generated for a message frame
+type wsTurn struct {
+	messageID string // empty until the provider has accepted the message
+	cancelled bool   // a cancel frame arrived before the message ID was known
+}
+
+// chat over a single WebSocket connection, answers are streamed back as the same events sent by /stream
+func handleWebSocket(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		log.Error().Err(err).Msg("Failed to upgrade WebSocket connection")
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(wsMaxFrameSize)
+
+	// the writer pings the peer, a peer that neither answers nor sends anything is dead and its reads time out
+	pingInterval := webSocketPingInterval()
+	extendDeadline := func() error { return conn.SetReadDeadline(time.Now().Add(2 * pingInterval)) }
+	extendDeadline()
+	conn.SetPongHandler(func(string) error { return extendDeadline() })
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	session := &wsSession{
+		conn:           conn,
+		ctx:            ctx,
+		outgoing:       make(chan models.StreamEvent, wsOutgoingQueue),
+		pingInterval:   pingInterval,
+		userID:         strings.TrimSpace(c.Query("user_id")),
+		conversationID: strings.TrimSpace(c.Query("conversation_id")),
+	}
+	go session.writeLoop(cancel)
+
+	log.Debug().Str("userID", session.userID).Msg("WebSocket connection opened")
+
+	for {
+		var frame models.WSClientFrame
+		if err := conn.ReadJSON(&frame); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Warn().Err(err).Msg("WebSocket connection closed unexpectedly")
+			}
+			return
+		}
+		extendDeadline()
+		session.handleFrame(frame)
+	}
+}
+
+// write queued frames and pings until the connection ends, a failed write closes the session
+func (s *wsSession) writeLoop(cancel context.CancelFunc) {
+	defer cancel()
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case frame := <-s.outgoing:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := s.conn.WriteJSON(frame); err != nil {
+				log.Warn().Err(err).Msg("Failed to write WebSocket frame")
+				// unblock the reader so the handler returns
+				s.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+				log.Warn().Err(err).Msg("Failed to ping WebSocket peer")
+				s.conn.Close()
+				return
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// queue a frame for the writer, dropped once the connection is gone
+func (s *wsSession) send(frame models.StreamEvent) bool {
+	select {
+	case s.outgoing <- frame:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *wsSession) sendError(message string) {
+	s.send(models.StreamEvent{Type: models.StreamEventError, Error: message})
+}
+
+func (s *wsSession) handleFrame(frame models.WSClientFrame) {
+	switch frame.Type {
+	case models.WSFrameMessage:
+		s.startTurn(frame)
+	case models.WSFrameCancel:
+		s.cancelTurn()
+	case models.WSFramePing:
+		s.send(models.StreamEvent{Type: models.WSFramePong})
+	case models.WSFrameSwitchConversation:
+		s.switchConversation(frame.ConversationID)
+	default:
+		s.sendError("Unknown frame type")
+	}
+}
+
+// start answering a message frame, one answer is generated at a time per connection. The answer is set up on
+// its own goroutine, so cancel and ping frames are still read while the provider is being reached.
+func (s *wsSession) startTurn(frame models.WSClientFrame) {
+	if strings.TrimSpace(frame.Message) == "" {
+		s.sendError("Message cannot be empty")
+		return
+	}
+
+	s.mutex.Lock()
+	if s.turn != nil {
+		s.mutex.Unlock()
+		s.sendError("An answer is already being generated")
+		return
+	}
+	turn := &wsTurn{}
+	s.turn = turn
+	request := models.ChatRequest{
+		UserID:           s.userID,
+		ConversationID:   s.conversationID,
+		Message:          frame.Message,
+		Model:            frame.Model,
+		GenerationParams: frame.GenerationParams,
+	}
+	s.mutex.Unlock()
+
+	go s.runTurn(turn, request)
+}
+
+// generate the answer of a turn and relay its events to the client
+func (s *wsSession) runTurn(turn *wsTurn, request models.ChatRequest) {
+	events, err := service.ProcessStream(s.ctx, &request)
+	if err != nil {
+		s.finishTurn(turn)
+		s.sendTurnError(err)
+		return
+	}
+
+	// the start event is buffered before ProcessStream returns, so it carries the message ID to cancel
+	start, ok := <-events
+	if !ok {
+		s.finishTurn(turn)
+		return
+	}
+
+	s.mutex.Lock()
+	// later messages continue the conversation the first one started
+	s.userID = request.UserID
+	s.conversationID = request.ConversationID
+	turn.messageID = start.MessageID
+	cancelled := turn.cancelled
+	s.mutex.Unlock()
+
+	s.send(start)
+	if cancelled {
+		s.cancelStream(request.UserID, start.MessageID)
+	}
+	s.forward(turn, events)
+}
+
+// report a message frame that could not be answered
+func (s *wsSession) sendTurnError(err error) {
+	_, message, code := serviceErrorResponse(err, "Streaming failed")
+	s.send(models.StreamEvent{Type: models.StreamEventError, Error: message, Code: code})
+}
+
+// relay the events of an answer to the client
+func (s *wsSession) forward(turn *wsTurn, events <-chan models.StreamEvent) {
+	defer s.finishTurn(turn)
+
+	for event := range events {
+		// the client may send its next message as soon as it sees done
+		if event.Type == models.StreamEventDone {
+			s.finishTurn(turn)
+		}
+		if !s.send(event) {
+			return
+		}
+	}
+}
+
+func (s *wsSession) finishTurn(turn *wsTurn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.turn == turn {
+		s.turn = nil
+	}
+}
+
+// cancel the answer being generated, one not accepted by the provider yet is cancelled as soon as it is
+func (s *wsSession) cancelTurn() {
+	s.mutex.Lock()
+	turn, userID := s.turn, s.userID
+	var messageID string
+	if turn != nil {
+		messageID = turn.messageID
+		turn.cancelled = messageID == ""
+	}
+	s.mutex.Unlock()
+
+	if turn == nil {
+		s.sendError("Nothing to cancel")
+		return
+	}
+	if messageID != "" {
+		s.cancelStream(userID, messageID)
+	}
+}
+
+// the answer ends with a done event whose finish_reason is cancelled
+func (s *wsSession) cancelStream(userID, messageID string) {
+	if err := service.CancelStream(s.ctx, userID, messageID); err != nil {
+		log.Warn().Err(err).Str("messageID", messageID).Msg("Failed to cancel stream")
+	}
+}
+
+// continue another conversation of the user, an empty ID starts a new one with the next message. The lock is
+// only held to read and change the session, not while the store is asked or the client written to.
+func (s *wsSession) switchConversation(conversationID string) {
+	s.mutex.Lock()
+	busy, userID := s.turn != nil, s.userID
+	s.mutex.Unlock()
+
+	if busy {
+		s.sendError("Cannot switch conversations while an answer is being generated")
+		return
+	}
+
+	if conversationID != "" {
+		if _, err := service.GetConversation(s.ctx, userID, conversationID); err != nil {
+			if errors.Is(err, db.ErrConversationNotFound) {
+				s.sendError("Conversation not found")
+				return
+			}
+			log.Error().Err(err).Msg("Failed to load conversation")
+			s.sendError("Failed to load conversation")
+			return
+		}
+	}
+
+	// turns are only started by frames read after this one, so none can have begun in the meantime
+	s.mutex.Lock()
+	s.conversationID = conversationID
+	s.mutex.Unlock()
+
+	s.send(models.StreamEvent{Type: models.WSFrameConversation, UserID: userID, ConversationID: conversationID})
+}
@@ -1,7 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+
+	"go-bot/internal/models"
 
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog/log"
@@ -12,6 +17,64 @@ type Config struct {
 	MongoURI     string
 	APIKey       string
 	Port         string
+
+	// chat persistence: mongo, postgres, sqlite or memory
+	StorageBackend string
+	SQLitePath     string
+	PostgresDSN    string
+
+	// LLM backend selection, LLMProviders is the fallback chain tried in order,
+	// each entry a provider name optionally followed by ":model"
+	LLMProvider  string
+	LLMProviders []string
+	// further "provider:model" entries clients may ask for by name, besides the models of LLMProviders
+	LLMAllowedModels []string
+	// upper bound on the max_tokens of a request
+	LLMMaxOutputTokens int
+	OpenAIBaseURL      string
+	OpenAIModel        string
+
+	AnthropicAPIKey  string
+	AnthropicBaseURL string
+	AnthropicModel   string
+
+	OllamaBaseURL string
+	OllamaModel   string
+
+	// context window packing
+	HistoryFetchLimit       int
+	CompletionReserveTokens int
+
+	// seconds a stream keeps generating without a client and stays resumable after it ends
+	StreamResumeWindowSeconds int
+
+	// retries of failed LLM calls
+	LLMMaxRetries       int
+	LLMRetryBaseDelayMs int
+	LLMRetryMaxDelayMs  int
+
+	// prices in USD per million tokens added to or overriding the built-in table
+	ModelPrices map[string]models.ModelPrice
+
+	// token and spend ceilings of every user and every API key, zero limits are off
+	UserQuota models.QuotaLimits
+	KeyQuota  models.QuotaLimits
+	// percentage of a quota after which responses carry a warning
+	QuotaSoftLimitPercent int
+
+	// request rate limits: memory, mongo or off, and the requests allowed per window
+	RateLimitBackend       string
+	RateLimitWindowSeconds int
+	RateLimitPerKey        int
+	RateLimitPerUser       int
+	RateLimitPerIP         int
+
+	// addresses or CIDR ranges of the reverse proxies whose X-Forwarded-For is believed, none by default
+	TrustedProxies []string
+
+	// browser origins allowed to open WebSocket connections besides the server's own, and the keepalive interval
+	WSAllowedOrigins      []string
+	WSPingIntervalSeconds int
 }
 
 // load configuration from environment variables
@@ -25,16 +88,81 @@ func LoadConfig() *Config {
 		MongoURI:     getEnv("MONGO_URI", ""),
 		APIKey:       getEnv("API_KEY", ""),
 		Port:         getEnv("PORT", "8080"),
+
+		StorageBackend: getEnv("STORAGE_BACKEND", "mongo"),
+		SQLitePath:     getEnv("SQLITE_PATH", "go-bot.db"),
+		PostgresDSN:    getEnv("POSTGRES_DSN", ""),
+
+		LLMProvider:   getEnv("LLM_PROVIDER", "openai"),
+		OpenAIBaseURL: getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"),
+		OpenAIModel:   getEnv("OPENAI_MODEL", "gpt-4-turbo"),
+
+		AnthropicAPIKey:  getEnv("ANTHROPIC_API_KEY", ""),
+		AnthropicBaseURL: getEnv("ANTHROPIC_BASE_URL", "https://api.anthropic.com/v1"),
+		AnthropicModel:   getEnv("ANTHROPIC_MODEL", "claude-3-5-sonnet-latest"),
+
+		OllamaBaseURL: getEnv("OLLAMA_BASE_URL", "http://localhost:11434"),
+		OllamaModel:   getEnv("OLLAMA_MODEL", "llama3.1"),
+
+		HistoryFetchLimit:       getEnvInt("CONTEXT_HISTORY_LIMIT", 50),
+		CompletionReserveTokens: getEnvInt("COMPLETION_RESERVE_TOKENS", 1024),
+
+		StreamResumeWindowSeconds: getEnvInt("STREAM_RESUME_WINDOW_SECONDS", 30),
+
+		LLMMaxRetries:       getEnvInt("LLM_MAX_RETRIES", 2),
+		LLMRetryBaseDelayMs: getEnvInt("LLM_RETRY_BASE_DELAY_MS", 500),
+		LLMRetryMaxDelayMs:  getEnvInt("LLM_RETRY_MAX_DELAY_MS", 10000),
+
+		UserQuota:             getEnvQuota("QUOTA_USER"),
+		KeyQuota:              getEnvQuota("QUOTA_KEY"),
+		QuotaSoftLimitPercent: getEnvInt("QUOTA_SOFT_LIMIT_PERCENT", 80),
+
+		RateLimitBackend:       getEnv("RATE_LIMIT_BACKEND", "memory"),
+		RateLimitWindowSeconds: getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60),
+		RateLimitPerKey:        getEnvInt("RATE_LIMIT_PER_KEY", 600),
+		RateLimitPerUser:       getEnvInt("RATE_LIMIT_PER_USER", 60),
+		RateLimitPerIP:         getEnvInt("RATE_LIMIT_PER_IP", 120),
+
+		TrustedProxies: getEnvList("TRUSTED_PROXIES"),
+
+		WSAllowedOrigins:      getEnvList("WS_ALLOWED_ORIGINS"),
+		WSPingIntervalSeconds: getEnvInt("WS_PING_INTERVAL_SECONDS", 30),
+	}
+
+	// without a chain only LLM_PROVIDER is used
+	config.LLMProviders = getEnvList("LLM_PROVIDERS")
+	if len(config.LLMProviders) == 0 {
+		config.LLMProviders = []string{config.LLMProvider}
 	}
+	config.LLMAllowedModels = getEnvList("LLM_ALLOWED_MODELS")
+	config.LLMMaxOutputTokens = getEnvInt("LLM_MAX_OUTPUT_TOKENS", 4096)
+	config.ModelPrices = getEnvPrices("MODEL_PRICES")
 
-	if config.OpenAIAPIKey == "" {
-		log.Fatal().Msg("environment variable OPENAI_API_KEY is missing")
+	// only the keys of the selected providers are mandatory, ollama needs none
+	for _, entry := range append(config.LLMProviders, config.LLMAllowedModels...) {
+		name, _, _ := strings.Cut(entry, ":")
+		switch name {
+		case "openai":
+			if config.OpenAIAPIKey == "" {
+				log.Fatal().Msg("environment variable OPENAI_API_KEY is missing")
+			}
+		case "anthropic":
+			if config.AnthropicAPIKey == "" {
+				log.Fatal().Msg("environment variable ANTHROPIC_API_KEY is missing")
+			}
+		}
+	}
+	if config.StorageBackend == "mongo" && config.MongoURI == "" {
+		log.Fatal().Msg("environment variable MONGO_URI is missing")
+	}
+	if config.StorageBackend == "postgres" && config.PostgresDSN == "" {
+		log.Fatal().Msg("environment variable POSTGRES_DSN is missing")
 	}
-	if config.MongoURI == "" {
+	if config.RateLimitBackend == "mongo" && config.MongoURI == "" {
 		log.Fatal().Msg("environment variable MONGO_URI is missing")
 	}
 	if config.APIKey == "" {
-		log.Fatal().Msg("environment variable API_KEY is missing")
+		log.Warn().Msg("API_KEY not set, only managed API keys are accepted")
 	}
 
 	return config
@@ -46,3 +174,68 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Warn().Str("key", key).Str("value", value).Msg("invalid integer in environment, using default")
+		return defaultValue
+	}
+	return parsed
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Warn().Str("key", key).Str("value", value).Msg("invalid number in environment, using default")
+		return defaultValue
+	}
+	return parsed
+}
+
+// quota limits read from <prefix>_DAILY_TOKENS, _MONTHLY_TOKENS, _DAILY_COST and _MONTHLY_COST
+func getEnvQuota(prefix string) models.QuotaLimits {
+	return models.QuotaLimits{
+		DailyTokens:   getEnvInt(prefix+"_DAILY_TOKENS", 0),
+		MonthlyTokens: getEnvInt(prefix+"_MONTHLY_TOKENS", 0),
+		DailyCost:     getEnvFloat(prefix+"_DAILY_COST", 0),
+		MonthlyCost:   getEnvFloat(prefix+"_MONTHLY_COST", 0),
+	}
+}
+
+// comma separated values, blank entries are skipped
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// model prices as "model=input/output" entries in USD per million tokens, e.g. "gpt-4o=2.5/10,llama3.1=0/0"
+func getEnvPrices(key string) map[string]models.ModelPrice {
+	prices := map[string]models.ModelPrice{}
+	for _, entry := range getEnvList(key) {
+		// model names may contain "=" in theory, prices never do
+		separator := strings.LastIndex(entry, "=")
+		if separator <= 0 {
+			log.Fatal().Str("key", key).Str("entry", entry).Msg("invalid model price, expected model=input/output")
+		}
+		var price models.ModelPrice
+		if _, err := fmt.Sscanf(entry[separator+1:], "%g/%g", &price.Input, &price.Output); err != nil || price.Input < 0 || price.Output < 0 {
+			log.Fatal().Str("key", key).Str("entry", entry).Msg("invalid model price, expected model=input/output")
+		}
+		prices[strings.TrimSpace(entry[:separator])] = price
+	}
+	return prices
+}
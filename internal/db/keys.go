@@ -0,0 +1,22 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go-bot/internal/models"
+)
+
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// APIKeyStore persists managed API keys, which are looked up by the hash of the key
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, key models.APIKey) error
+	// return the key with the given hash, revoked and expired ones included
+	GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error)
+	// list every key, newest first
+	ListAPIKeys(ctx context.Context) ([]models.APIKey, error)
+	// mark a key revoked, a key already revoked keeps its revocation time
+	RevokeAPIKey(ctx context.Context, keyID string, at time.Time) (*models.APIKey, error)
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go-bot/internal/models"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryStore is an in-process ChatStore, used for tests and local development
+type MemoryStore struct {
+	mutex         sync.RWMutex
+	conversations map[string]models.Conversation
+	messages      []models.ChatMessage
+	apiKeys       []models.APIKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		conversations: map[string]models.Conversation{},
+	}
+}
+
+func (s *MemoryStore) CreateConversation(ctx context.Context, userID, apiKeyID, title string) (*models.Conversation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	conversation := models.Conversation{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		APIKeyID:  apiKeyID,
+		Title:     title,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	s.conversations[conversation.ID.Hex()] = conversation
+
+	log.Debug().
+		Str("userID", userID).
+		Str("conversationID", conversation.ID.Hex()).
+		Msg("Creating conversation")
+
+	return &conversation, nil
+}
+
+func (s *MemoryStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	conversation, ok := s.conversations[conversationID]
+	if !ok {
+		return nil, ErrConversationNotFound
+	}
+	return &conversation, nil
+}
+
+func (s *MemoryStore) ListConversations(ctx context.Context, userID string, includeArchived bool) ([]models.Conversation, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	conversations := []models.Conversation{}
+	for _, conversation := range s.conversations {
+		if conversation.UserID != userID || (conversation.Archived && !includeArchived) {
+			continue
+		}
+		conversations = append(conversations, conversation)
+	}
+
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].UpdatedAt.After(conversations[j].UpdatedAt)
+	})
+	return conversations, nil
+}
+
+func (s *MemoryStore) UpdateConversation(ctx context.Context, conversationID string, update models.ConversationUpdate) (*models.Conversation, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conversation, ok := s.conversations[conversationID]
+	if !ok {
+		return nil, ErrConversationNotFound
+	}
+	if update.Title != nil {
+		conversation.Title = *update.Title
+	}
+	if update.Archived != nil {
+		conversation.Archived = *update.Archived
+	}
+	s.conversations[conversationID] = conversation
+	return &conversation, nil
+}
+
+func (s *MemoryStore) DeleteConversation(ctx context.Context, conversationID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.conversations[conversationID]; !ok {
+		return ErrConversationNotFound
+	}
+	delete(s.conversations, conversationID)
+
+	remaining := s.messages[:0]
+	for _, message := range s.messages {
+		if message.ConversationID != conversationID {
+			remaining = append(remaining, message)
+		}
+	}
+	s.messages = remaining
+	return nil
+}
+
+func (s *MemoryStore) SaveChat(ctx context.Context, chat models.ChatMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	fillChatDefaults(&chat)
+	s.messages = append(s.messages, chat)
+
+	// bump the conversation so recently active ones are listed first
+	if conversation, ok := s.conversations[chat.ConversationID]; ok {
+		conversation.UpdatedAt = chat.Timestamp
+		s.conversations[chat.ConversationID] = conversation
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetChatHistory(ctx context.Context, conversationID string, limit int) ([]models.ChatMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// messages are kept in insertion order, so walk backwards to find the newest ones
+	var chats []models.ChatMessage
+	for i := len(s.messages) - 1; i >= 0 && len(chats) < limit; i-- {
+		if s.messages[i].ConversationID == conversationID {
+			chats = append(chats, s.messages[i])
+		}
+	}
+
+	// reverse order to send oldest messages first
+	for i, j := 0, len(chats)-1; i < j; i, j = i+1, j-1 {
+		chats[i], chats[j] = chats[j], chats[i]
+	}
+	return chats, nil
+}
+
+func (s *MemoryStore) GetDailyUsage(ctx context.Context, userID string, from, to time.Time) ([]models.DailyUsage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	type key struct{ userID, day string }
+	days := map[key]*models.DailyUsage{}
+	for _, chat := range s.messages {
+		if (userID != "" && chat.UserID != userID) || chat.Timestamp.Before(from) || !chat.Timestamp.Before(to) {
+			continue
+		}
+		k := key{chat.UserID, chat.Timestamp.UTC().Format(time.DateOnly)}
+		day, ok := days[k]
+		if !ok {
+			day = &models.DailyUsage{UserID: k.userID, Day: k.day}
+			days[k] = day
+		}
+		day.Messages++
+		day.PromptTokens += chat.Usage.PromptTokens
+		day.CompletionTokens += chat.Usage.CompletionTokens
+		day.TotalTokens += chat.Usage.TotalTokens
+		day.Cost += chat.Cost
+	}
+
+	usage := make([]models.DailyUsage, 0, len(days))
+	for _, day := range days {
+		usage = append(usage, *day)
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		if usage[i].Day != usage[j].Day {
+			return usage[i].Day < usage[j].Day
+		}
+		return usage[i].UserID < usage[j].UserID
+	})
+	return usage, nil
+}
+
+func (s *MemoryStore) SumUsage(ctx context.Context, from, to time.Time, groupBy string) ([]models.UsageTotal, error) {
+	if _, err := usageGroupField(groupBy); err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	groups := map[string]*models.UsageTotal{}
+	for _, chat := range s.messages {
+		if chat.Timestamp.Before(from) || !chat.Timestamp.Before(to) {
+			continue
+		}
+		key := chat.UserID
+		switch groupBy {
+		case models.UsageGroupKey:
+			key = chat.APIKeyID
+		case models.UsageGroupModel:
+			key = chat.Model
+		}
+		total, ok := groups[key]
+		if !ok {
+			total = &models.UsageTotal{Group: key}
+			groups[key] = total
+		}
+		total.Messages++
+		total.PromptTokens += chat.Usage.PromptTokens
+		total.CompletionTokens += chat.Usage.CompletionTokens
+		total.TotalTokens += chat.Usage.TotalTokens
+		total.Cost += chat.Cost
+	}
+
+	totals := make([]models.UsageTotal, 0, len(groups))
+	for _, total := range groups {
+		totals = append(totals, *total)
+	}
+	sortUsageTotals(totals)
+	return totals, nil
+}
+
+func (s *MemoryStore) GetUsageTotal(ctx context.Context, groupBy, group string, from, to time.Time) (models.UsageTotal, error) {
+	total := models.UsageTotal{Group: group}
+	totals, err := s.SumUsage(ctx, from, to, groupBy)
+	if err != nil {
+		return total, err
+	}
+	for _, candidate := range totals {
+		if candidate.Group == group {
+			return candidate, nil
+		}
+	}
+	return total, nil
+}
+
+func (s *MemoryStore) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.apiKeys = append(s.apiKeys, key)
+	return nil
+}
+
+func (s *MemoryStore) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, key := range s.apiKeys {
+		if key.Hash == hash {
+			return &key, nil
+		}
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (s *MemoryStore) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// keys are kept in creation order
+	keys := make([]models.APIKey, 0, len(s.apiKeys))
+	for i := len(s.apiKeys) - 1; i >= 0; i-- {
+		keys = append(keys, s.apiKeys[i])
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) RevokeAPIKey(ctx context.Context, keyID string, at time.Time) (*models.APIKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.apiKeys {
+		if s.apiKeys[i].ID.Hex() != keyID {
+			continue
+		}
+		if s.apiKeys[i].RevokedAt == nil {
+			s.apiKeys[i].RevokedAt = &at
+		}
+		key := s.apiKeys[i]
+		return &key, nil
+	}
+	return nil, ErrAPIKeyNotFound
+}
+
+func (s *MemoryStore) IsConnected() bool {
+	return true
+}
+
+func (s *MemoryStore) Disconnect() error {
+	return nil
+}
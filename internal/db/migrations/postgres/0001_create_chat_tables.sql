@@ -0,0 +1,22 @@
+CREATE TABLE conversations (
+    id         TEXT PRIMARY KEY,
+    user_id    TEXT NOT NULL,
+    title      TEXT NOT NULL DEFAULT '',
+    archived   BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_conversations_user_updated ON conversations (user_id, updated_at DESC);
+
+CREATE TABLE chat_messages (
+    seq             BIGSERIAL PRIMARY KEY,
+    id              TEXT NOT NULL UNIQUE,
+    user_id         TEXT NOT NULL,
+    conversation_id TEXT NOT NULL,
+    message         TEXT NOT NULL,
+    response        TEXT NOT NULL,
+    timestamp       TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idx_chat_messages_conversation ON chat_messages (conversation_id, seq DESC);
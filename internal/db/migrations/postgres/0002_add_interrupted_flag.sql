@@ -0,0 +1 @@
+ALTER TABLE chat_messages ADD COLUMN interrupted BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1 @@
+ALTER TABLE chat_messages ADD COLUMN parameters TEXT;
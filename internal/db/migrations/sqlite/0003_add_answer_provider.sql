@@ -0,0 +1,2 @@
+ALTER TABLE chat_messages ADD COLUMN provider TEXT NOT NULL DEFAULT '';
+ALTER TABLE chat_messages ADD COLUMN model TEXT NOT NULL DEFAULT '';
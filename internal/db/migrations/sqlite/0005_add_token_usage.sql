@@ -0,0 +1,5 @@
+ALTER TABLE chat_messages ADD COLUMN prompt_tokens INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chat_messages ADD COLUMN completion_tokens INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chat_messages ADD COLUMN total_tokens INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX idx_chat_messages_user_timestamp ON chat_messages (user_id, timestamp);
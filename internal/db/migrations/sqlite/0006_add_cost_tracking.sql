@@ -0,0 +1,4 @@
+ALTER TABLE chat_messages ADD COLUMN api_key_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE chat_messages ADD COLUMN cost REAL NOT NULL DEFAULT 0;
+
+CREATE INDEX idx_chat_messages_timestamp ON chat_messages (timestamp);
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"sync"
 	"time"
 
@@ -10,28 +11,41 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var (
-	client         *mongo.Client
-	chatCollection *mongo.Collection
-	clientMutex    sync.RWMutex
-)
+// MongoStore is the MongoDB implementation of ChatStore
+type MongoStore struct {
+	client                 *mongo.Client
+	chatCollection         *mongo.Collection
+	conversationCollection *mongo.Collection
+	apiKeyCollection       *mongo.Collection
+	clientMutex            sync.RWMutex
+}
+
+// connect to MongoDB and return a store backed by it
+func NewMongoStore(mongoURI string) (*MongoStore, error) {
+	store := &MongoStore{}
+	if err := store.Connect(mongoURI); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
 
-func Connect(mongoURI string) error {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
+func (s *MongoStore) Connect(mongoURI string) error {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
 
 	// reuse existing connection if valid
-	if client != nil {
+	if s.client != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
-		if err := client.Ping(ctx, nil); err == nil {
+		if err := s.client.Ping(ctx, nil); err == nil {
 			return nil
 		}
-		_ = client.Disconnect(context.Background())
+		_ = s.client.Disconnect(context.Background())
 	}
 
 	clientOptions := options.Client().
@@ -48,12 +62,16 @@ func Connect(mongoURI string) error {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
 		log.Debug().Msgf("MongoDB connection attempt %d/3", attempts)
-		client, err = mongo.Connect(ctx, clientOptions)
+		s.client, err = mongo.Connect(ctx, clientOptions)
 
 		if err == nil {
 			// test connection
-			if err = client.Ping(ctx, nil); err == nil {
-				chatCollection = client.Database("go-chat-backend").Collection("chatSchema")
+			if err = s.client.Ping(ctx, nil); err == nil {
+				database := s.client.Database("go-chat-backend")
+				s.chatCollection = database.Collection("chatSchema")
+				s.conversationCollection = database.Collection("conversations")
+				s.apiKeyCollection = database.Collection("apiKeys")
+				s.ensureIndexes(ctx)
 				log.Info().Msg("MongoDB connection successful")
 				cancel()
 				return nil
@@ -70,58 +88,271 @@ func Connect(mongoURI string) error {
 	return err
 }
 
-func SaveChat(userID, message, response string) error {
-	clientMutex.RLock()
-	defer clientMutex.RUnlock()
+// create the indexes used by history, usage and conversation lookups
+func (s *MongoStore) ensureIndexes(ctx context.Context) {
+	_, err := s.chatCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "conversation_id", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to create chat history index")
+	}
 
-	if chatCollection == nil {
-		return mongo.ErrClientDisconnected
+	_, err = s.chatCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "timestamp", Value: 1}},
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to create usage index")
+	}
+
+	_, err = s.conversationCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "updated_at", Value: -1}},
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to create conversation index")
+	}
+
+	_, err = s.apiKeyCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to create API key index")
+	}
+}
+
+func (s *MongoStore) CreateConversation(ctx context.Context, userID, apiKeyID, title string) (*models.Conversation, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.conversationCollection == nil {
+		return nil, mongo.ErrClientDisconnected
 	}
 
-	chat := models.ChatMessage{
+	now := time.Now()
+	conversation := models.Conversation{
+		ID:        primitive.NewObjectID(),
 		UserID:    userID,
-		Message:   message,
-		Response:  response,
-		Timestamp: time.Now(),
+		APIKeyID:  apiKeyID,
+		Title:     title,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	log.Debug().
 		Str("userID", userID).
-		Str("message", message).
+		Str("conversationID", conversation.ID.Hex()).
+		Msg("Creating conversation")
+
+	if _, err := s.conversationCollection.InsertOne(ctx, conversation); err != nil {
+		log.Error().Err(err).Msg("Failed to create conversation")
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (s *MongoStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.conversationCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return nil, ErrConversationNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var conversation models.Conversation
+	err = s.conversationCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&conversation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve conversation")
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (s *MongoStore) ListConversations(ctx context.Context, userID string, includeArchived bool) ([]models.Conversation, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.conversationCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("userID", userID).
+		Bool("includeArchived", includeArchived).
+		Msg("Listing conversations")
+
+	filter := bson.M{"user_id": userID}
+	if !includeArchived {
+		filter["archived"] = false
+	}
+	findOptions := options.Find().SetSort(bson.M{"updated_at": -1})
+
+	cursor, err := s.conversationCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list conversations")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	conversations := []models.Conversation{}
+	if err := cursor.All(ctx, &conversations); err != nil {
+		log.Error().Err(err).Msg("Failed to decode conversations")
+		return nil, err
+	}
+	return conversations, nil
+}
+
+func (s *MongoStore) UpdateConversation(ctx context.Context, conversationID string, update models.ConversationUpdate) (*models.Conversation, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.conversationCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return nil, ErrConversationNotFound
+	}
+
+	fields := bson.M{}
+	if update.Title != nil {
+		fields["title"] = *update.Title
+	}
+	if update.Archived != nil {
+		fields["archived"] = *update.Archived
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("conversationID", conversationID).
+		Interface("fields", fields).
+		Msg("Updating conversation")
+
+	var conversation models.Conversation
+	findOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = s.conversationCollection.FindOneAndUpdate(ctx, bson.M{"_id": objectID}, bson.M{"$set": fields}, findOptions).Decode(&conversation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update conversation")
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// delete a conversation together with all of its messages
+func (s *MongoStore) DeleteConversation(ctx context.Context, conversationID string) error {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.conversationCollection == nil || s.chatCollection == nil {
+		return mongo.ErrClientDisconnected
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(conversationID)
+	if err != nil {
+		return ErrConversationNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().Str("conversationID", conversationID).Msg("Deleting conversation")
+
+	result, err := s.conversationCollection.DeleteOne(ctx, bson.M{"_id": objectID})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete conversation")
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrConversationNotFound
+	}
+
+	if _, err := s.chatCollection.DeleteMany(ctx, bson.M{"conversation_id": conversationID}); err != nil {
+		log.Error().Err(err).Msg("Failed to delete conversation messages")
+		return err
+	}
+	return nil
+}
+
+func (s *MongoStore) SaveChat(ctx context.Context, chat models.ChatMessage) error {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.chatCollection == nil {
+		return mongo.ErrClientDisconnected
+	}
+
+	fillChatDefaults(&chat)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("userID", chat.UserID).
+		Str("conversationID", chat.ConversationID).
+		Str("message", chat.Message).
+		Bool("interrupted", chat.Interrupted).
 		Msg("Saving chat message")
 
-	_, err := chatCollection.InsertOne(ctx, chat)
+	_, err := s.chatCollection.InsertOne(ctx, chat)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to save chat message")
+		return err
 	}
-	return err
+
+	// bump the conversation so recently active ones are listed first
+	if objectID, err := primitive.ObjectIDFromHex(chat.ConversationID); err == nil {
+		update := bson.M{"$set": bson.M{"updated_at": chat.Timestamp}}
+		if _, err := s.conversationCollection.UpdateByID(ctx, objectID, update); err != nil {
+			log.Warn().Err(err).Msg("Failed to update conversation timestamp")
+		}
+	}
+	return nil
 }
 
-func GetChatHistory(userID string, limit int) ([]models.ChatMessage, error) {
-	clientMutex.RLock()
-	defer clientMutex.RUnlock()
+func (s *MongoStore) GetChatHistory(ctx context.Context, conversationID string, limit int) ([]models.ChatMessage, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
 
-	if chatCollection == nil {
+	if s.chatCollection == nil {
 		return nil, mongo.ErrClientDisconnected
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	log.Debug().
-		Str("userID", userID).
+		Str("conversationID", conversationID).
 		Int("limit", limit).
 		Msg("Retrieving chat history")
 
-	filter := bson.M{"user_id": userID}
+	filter := bson.M{"conversation_id": conversationID}
 	findOptions := options.Find().
 		SetSort(bson.M{"timestamp": -1}).
 		SetLimit(int64(limit))
 
-	cursor, err := chatCollection.Find(ctx, filter, findOptions)
+	cursor, err := s.chatCollection.Find(ctx, filter, findOptions)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to retrieve chat history")
 		return nil, err
@@ -146,27 +377,307 @@ func GetChatHistory(userID string, limit int) ([]models.ChatMessage, error) {
 	return chats, nil
 }
 
-func IsConnected() bool {
-	clientMutex.RLock()
-	defer clientMutex.RUnlock()
+func (s *MongoStore) GetDailyUsage(ctx context.Context, userID string, from, to time.Time) ([]models.DailyUsage, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.chatCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("userID", userID).
+		Time("from", from).
+		Time("to", to).
+		Msg("Aggregating daily usage")
+
+	match := bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}
+	if userID != "" {
+		match["user_id"] = userID
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"user_id": "$user_id",
+				"day":     bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$timestamp", "timezone": "UTC"}},
+			},
+			"messages":          bson.M{"$sum": 1},
+			"prompt_tokens":     bson.M{"$sum": "$usage.prompt_tokens"},
+			"completion_tokens": bson.M{"$sum": "$usage.completion_tokens"},
+			"total_tokens":      bson.M{"$sum": "$usage.total_tokens"},
+			"cost":              bson.M{"$sum": "$cost"},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":               0,
+			"user_id":           "$_id.user_id",
+			"day":               "$_id.day",
+			"messages":          1,
+			"prompt_tokens":     1,
+			"completion_tokens": 1,
+			"total_tokens":      1,
+			"cost":              1,
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "day", Value: 1}, {Key: "user_id", Value: 1}}}},
+	}
+
+	cursor, err := s.chatCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to aggregate daily usage")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	usage := []models.DailyUsage{}
+	if err := cursor.All(ctx, &usage); err != nil {
+		log.Error().Err(err).Msg("Failed to decode daily usage")
+		return nil, err
+	}
+	return usage, nil
+}
+
+func (s *MongoStore) SumUsage(ctx context.Context, from, to time.Time, groupBy string) ([]models.UsageTotal, error) {
+	field, err := usageGroupField(groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.chatCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("groupBy", groupBy).
+		Time("from", from).
+		Time("to", to).
+		Msg("Summing usage")
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}}},
+		{{Key: "$group", Value: bson.M{
+			// messages saved before a field existed are grouped with those where it is empty
+			"_id":               bson.M{"$ifNull": bson.A{"$" + field, ""}},
+			"messages":          bson.M{"$sum": 1},
+			"prompt_tokens":     bson.M{"$sum": "$usage.prompt_tokens"},
+			"completion_tokens": bson.M{"$sum": "$usage.completion_tokens"},
+			"total_tokens":      bson.M{"$sum": "$usage.total_tokens"},
+			"cost":              bson.M{"$sum": "$cost"},
+		}}},
+		{{Key: "$project", Value: bson.M{
+			"_id":               0,
+			"group":             "$_id",
+			"messages":          1,
+			"prompt_tokens":     1,
+			"completion_tokens": 1,
+			"total_tokens":      1,
+			"cost":              1,
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "cost", Value: -1}, {Key: "group", Value: 1}}}},
+	}
+
+	cursor, err := s.chatCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sum usage")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	totals := []models.UsageTotal{}
+	if err := cursor.All(ctx, &totals); err != nil {
+		log.Error().Err(err).Msg("Failed to decode usage totals")
+		return nil, err
+	}
+	return totals, nil
+}
+
+func (s *MongoStore) GetUsageTotal(ctx context.Context, groupBy, group string, from, to time.Time) (models.UsageTotal, error) {
+	total := models.UsageTotal{Group: group}
+	field, err := usageGroupField(groupBy)
+	if err != nil {
+		return total, err
+	}
+
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.chatCollection == nil {
+		return total, mongo.ErrClientDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{field: group, "timestamp": bson.M{"$gte": from, "$lt": to}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":               nil,
+			"messages":          bson.M{"$sum": 1},
+			"prompt_tokens":     bson.M{"$sum": "$usage.prompt_tokens"},
+			"completion_tokens": bson.M{"$sum": "$usage.completion_tokens"},
+			"total_tokens":      bson.M{"$sum": "$usage.total_tokens"},
+			"cost":              bson.M{"$sum": "$cost"},
+		}}},
+	}
+
+	cursor, err := s.chatCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Error().Err(err).Str("groupBy", groupBy).Msg("Failed to sum usage")
+		return total, err
+	}
+	defer cursor.Close(ctx)
+
+	// no document is returned without matching messages
+	if cursor.Next(ctx) {
+		if err := cursor.Decode(&total); err != nil {
+			log.Error().Err(err).Msg("Failed to decode usage total")
+			return total, err
+		}
+		total.Group = group
+	}
+	return total, cursor.Err()
+}
+
+func (s *MongoStore) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.apiKeyCollection == nil {
+		return mongo.ErrClientDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("keyID", key.ID.Hex()).
+		Str("name", key.Name).
+		Msg("Creating API key")
+
+	if _, err := s.apiKeyCollection.InsertOne(ctx, key); err != nil {
+		log.Error().Err(err).Msg("Failed to create API key")
+		return err
+	}
+	return nil
+}
+
+func (s *MongoStore) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.apiKeyCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var key models.APIKey
+	err := s.apiKeyCollection.FindOne(ctx, bson.M{"hash": hash}).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up API key")
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *MongoStore) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.apiKeyCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// object IDs grow with their creation time
+	cursor, err := s.apiKeyCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}))
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list API keys")
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []models.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		log.Error().Err(err).Msg("Failed to decode API keys")
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *MongoStore) RevokeAPIKey(ctx context.Context, keyID string, at time.Time) (*models.APIKey, error) {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	if s.apiKeyCollection == nil {
+		return nil, mongo.ErrClientDisconnected
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(keyID)
+	if err != nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().Str("keyID", keyID).Msg("Revoking API key")
+
+	// a key already revoked keeps its revocation time
+	if _, err := s.apiKeyCollection.UpdateOne(ctx,
+		bson.M{"_id": objectID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": at}},
+	); err != nil {
+		log.Error().Err(err).Msg("Failed to revoke API key")
+		return nil, err
+	}
+
+	var key models.APIKey
+	err = s.apiKeyCollection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&key)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *MongoStore) IsConnected() bool {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
 
-	if client == nil {
+	if s.client == nil {
 		return false
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	return client.Ping(ctx, nil) == nil
+	return s.client.Ping(ctx, nil) == nil
 }
 
-func Disconnect() error {
-	clientMutex.Lock()
-	defer clientMutex.Unlock()
+func (s *MongoStore) Disconnect() error {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
 
-	if client != nil {
+	if s.client != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
-		return client.Disconnect(ctx)
+		return s.client.Disconnect(ctx)
 	}
 	return nil
 }
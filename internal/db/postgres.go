@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/rs/zerolog/log"
+)
+
+// connect to PostgreSQL and return a store backed by it, pending migrations are applied first
+func NewPostgresStore(dsn string) (*SQLStore, error) {
+	database, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	database.SetMaxOpenConns(5)
+	database.SetConnMaxIdleTime(5 * time.Minute)
+
+	// try to connect with retries
+	for attempts := 1; attempts <= 3; attempts++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+		log.Debug().Msgf("PostgreSQL connection attempt %d/3", attempts)
+		err = database.PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			break
+		}
+		if attempts < 3 {
+			time.Sleep(time.Second * 2)
+		}
+	}
+	if err != nil {
+		database.Close()
+		log.Error().Err(err).Msg("All PostgreSQL connection attempts failed")
+		return nil, err
+	}
+
+	store, err := newSQLStore(database, "postgres")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to migrate PostgreSQL database")
+		return nil, err
+	}
+
+	log.Info().Msg("PostgreSQL connection successful")
+	return store, nil
+}
@@ -0,0 +1,533 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"go-bot/internal/models"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SQLStore is a ChatStore on top of database/sql, queries stick to SQL understood by both SQLite and PostgreSQL
+type SQLStore struct {
+	database *sql.DB
+	dialect  string
+}
+
+// wrap an open database and bring its schema up to date
+func newSQLStore(database *sql.DB, dialect string) (*SQLStore, error) {
+	if err := runMigrations(database, dialect); err != nil {
+		database.Close()
+		return nil, err
+	}
+	return &SQLStore{database: database, dialect: dialect}, nil
+}
+
+func (s *SQLStore) CreateConversation(ctx context.Context, userID, apiKeyID, title string) (*models.Conversation, error) {
+	now := time.Now().UTC()
+	conversation := models.Conversation{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		APIKeyID:  apiKeyID,
+		Title:     title,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("userID", userID).
+		Str("conversationID", conversation.ID.Hex()).
+		Msg("Creating conversation")
+
+	_, err := s.database.ExecContext(ctx,
+		"INSERT INTO conversations (id, user_id, api_key_id, title, archived, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		conversation.ID.Hex(), conversation.UserID, conversation.APIKeyID, conversation.Title, conversation.Archived, conversation.CreatedAt, conversation.UpdatedAt,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create conversation")
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// scan a conversation row selected with conversationColumns
+func scanConversation(row interface{ Scan(...any) error }) (*models.Conversation, error) {
+	var (
+		conversation models.Conversation
+		id           string
+	)
+	err := row.Scan(&id, &conversation.UserID, &conversation.APIKeyID, &conversation.Title, &conversation.Archived, &conversation.CreatedAt, &conversation.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if conversation.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+const conversationColumns = "id, user_id, api_key_id, title, archived, created_at, updated_at"
+
+func (s *SQLStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	row := s.database.QueryRowContext(ctx, "SELECT "+conversationColumns+" FROM conversations WHERE id = $1", conversationID)
+	conversation, err := scanConversation(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrConversationNotFound
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve conversation")
+		return nil, err
+	}
+	return conversation, nil
+}
+
+func (s *SQLStore) ListConversations(ctx context.Context, userID string, includeArchived bool) ([]models.Conversation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("userID", userID).
+		Bool("includeArchived", includeArchived).
+		Msg("Listing conversations")
+
+	query := "SELECT " + conversationColumns + " FROM conversations WHERE user_id = $1"
+	if !includeArchived {
+		query += " AND archived = $2"
+	}
+	query += " ORDER BY updated_at DESC"
+
+	args := []any{userID}
+	if !includeArchived {
+		args = append(args, false)
+	}
+
+	rows, err := s.database.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list conversations")
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []models.Conversation{}
+	for rows.Next() {
+		conversation, err := scanConversation(rows)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to decode conversations")
+			return nil, err
+		}
+		conversations = append(conversations, *conversation)
+	}
+	return conversations, rows.Err()
+}
+
+func (s *SQLStore) UpdateConversation(ctx context.Context, conversationID string, update models.ConversationUpdate) (*models.Conversation, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().Str("conversationID", conversationID).Msg("Updating conversation")
+
+	// nil fields keep their current value
+	result, err := s.database.ExecContext(ctx,
+		"UPDATE conversations SET title = COALESCE($1, title), archived = COALESCE($2, archived) WHERE id = $3",
+		update.Title, update.Archived, conversationID,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to update conversation")
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return nil, ErrConversationNotFound
+	}
+	return s.GetConversation(ctx, conversationID)
+}
+
+func (s *SQLStore) DeleteConversation(ctx context.Context, conversationID string) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().Str("conversationID", conversationID).Msg("Deleting conversation")
+
+	tx, err := s.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM conversations WHERE id = $1", conversationID)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to delete conversation")
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return ErrConversationNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chat_messages WHERE conversation_id = $1", conversationID); err != nil {
+		log.Error().Err(err).Msg("Failed to delete conversation messages")
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) SaveChat(ctx context.Context, chat models.ChatMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	fillChatDefaults(&chat)
+	chat.Timestamp = chat.Timestamp.UTC()
+
+	log.Debug().
+		Str("userID", chat.UserID).
+		Str("conversationID", chat.ConversationID).
+		Str("message", chat.Message).
+		Bool("interrupted", chat.Interrupted).
+		Msg("Saving chat message")
+
+	parameters, err := encodeParameters(chat.Parameters)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.database.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO chat_messages (id, user_id, conversation_id, message, response, timestamp, interrupted, provider, model, parameters, prompt_tokens, completion_tokens, total_tokens, cost, api_key_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)",
+		chat.ID.Hex(), chat.UserID, chat.ConversationID, chat.Message, chat.Response, chat.Timestamp, chat.Interrupted, chat.Provider, chat.Model, parameters,
+		chat.Usage.PromptTokens, chat.Usage.CompletionTokens, chat.Usage.TotalTokens, chat.Cost, chat.APIKeyID,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to save chat message")
+		return err
+	}
+
+	// bump the conversation so recently active ones are listed first
+	if _, err := tx.ExecContext(ctx, "UPDATE conversations SET updated_at = $1 WHERE id = $2", chat.Timestamp, chat.ConversationID); err != nil {
+		log.Warn().Err(err).Msg("Failed to update conversation timestamp")
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) GetChatHistory(ctx context.Context, conversationID string, limit int) ([]models.ChatMessage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("conversationID", conversationID).
+		Int("limit", limit).
+		Msg("Retrieving chat history")
+
+	rows, err := s.database.QueryContext(ctx,
+		"SELECT id, user_id, conversation_id, message, response, timestamp, interrupted, provider, model, parameters, prompt_tokens, completion_tokens, total_tokens, cost, api_key_id FROM chat_messages WHERE conversation_id = $1 ORDER BY seq DESC LIMIT $2",
+		conversationID, limit,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve chat history")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []models.ChatMessage
+	for rows.Next() {
+		var (
+			chat       models.ChatMessage
+			id         string
+			parameters sql.NullString
+		)
+		if err := rows.Scan(&id, &chat.UserID, &chat.ConversationID, &chat.Message, &chat.Response, &chat.Timestamp, &chat.Interrupted, &chat.Provider, &chat.Model, &parameters,
+			&chat.Usage.PromptTokens, &chat.Usage.CompletionTokens, &chat.Usage.TotalTokens, &chat.Cost, &chat.APIKeyID); err != nil {
+			log.Error().Err(err).Msg("Failed to decode chat messages")
+			return nil, err
+		}
+		if chat.Parameters, err = decodeParameters(parameters); err != nil {
+			log.Error().Err(err).Msg("Failed to decode chat message parameters")
+			return nil, err
+		}
+		chat.ID, _ = primitive.ObjectIDFromHex(id)
+		chats = append(chats, chat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// reverse order to send oldest messages first
+	for i, j := 0, len(chats)-1; i < j; i, j = i+1, j-1 {
+		chats[i], chats[j] = chats[j], chats[i]
+	}
+
+	log.Debug().
+		Int("messageCount", len(chats)).
+		Msg("Successfully retrieved chat history")
+
+	return chats, nil
+}
+
+func (s *SQLStore) IsConnected() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return s.database.PingContext(ctx) == nil
+}
+
+func (s *SQLStore) Disconnect() error {
+	return s.database.Close()
+}
+
+func (s *SQLStore) GetDailyUsage(ctx context.Context, userID string, from, to time.Time) ([]models.DailyUsage, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("userID", userID).
+		Time("from", from).
+		Time("to", to).
+		Msg("Aggregating daily usage")
+
+	query := "SELECT user_id, " + s.dayExpression("timestamp") + " AS day, COUNT(*), SUM(prompt_tokens), SUM(completion_tokens), SUM(total_tokens), SUM(cost)" +
+		" FROM chat_messages WHERE timestamp >= $1 AND timestamp < $2"
+	// timestamps are saved in UTC, so the bounds are too
+	args := []any{from.UTC(), to.UTC()}
+	if userID != "" {
+		query += " AND user_id = $3"
+		args = append(args, userID)
+	}
+	query += " GROUP BY user_id, day ORDER BY day, user_id"
+
+	rows, err := s.database.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to aggregate daily usage")
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []models.DailyUsage{}
+	for rows.Next() {
+		var day models.DailyUsage
+		if err := rows.Scan(&day.UserID, &day.Day, &day.Messages, &day.PromptTokens, &day.CompletionTokens, &day.TotalTokens, &day.Cost); err != nil {
+			log.Error().Err(err).Msg("Failed to decode daily usage")
+			return nil, err
+		}
+		usage = append(usage, day)
+	}
+	return usage, rows.Err()
+}
+
+func (s *SQLStore) SumUsage(ctx context.Context, from, to time.Time, groupBy string) ([]models.UsageTotal, error) {
+	column, err := usageGroupField(groupBy)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("groupBy", groupBy).
+		Time("from", from).
+		Time("to", to).
+		Msg("Summing usage")
+
+	rows, err := s.database.QueryContext(ctx,
+		"SELECT "+column+", COUNT(*), SUM(prompt_tokens), SUM(completion_tokens), SUM(total_tokens), SUM(cost)"+
+			" FROM chat_messages WHERE timestamp >= $1 AND timestamp < $2"+
+			" GROUP BY "+column+" ORDER BY SUM(cost) DESC, "+column,
+		from.UTC(), to.UTC(),
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to sum usage")
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []models.UsageTotal{}
+	for rows.Next() {
+		var total models.UsageTotal
+		if err := rows.Scan(&total.Group, &total.Messages, &total.PromptTokens, &total.CompletionTokens, &total.TotalTokens, &total.Cost); err != nil {
+			log.Error().Err(err).Msg("Failed to decode usage totals")
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
+
+func (s *SQLStore) GetUsageTotal(ctx context.Context, groupBy, group string, from, to time.Time) (models.UsageTotal, error) {
+	total := models.UsageTotal{Group: group}
+	column, err := usageGroupField(groupBy)
+	if err != nil {
+		return total, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	// sums are NULL without matching messages
+	err = s.database.QueryRowContext(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(prompt_tokens), 0), COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(total_tokens), 0), COALESCE(SUM(cost), 0)"+
+			" FROM chat_messages WHERE "+column+" = $1 AND timestamp >= $2 AND timestamp < $3",
+		group, from.UTC(), to.UTC(),
+	).Scan(&total.Messages, &total.PromptTokens, &total.CompletionTokens, &total.TotalTokens, &total.Cost)
+	if err != nil {
+		log.Error().Err(err).Str("groupBy", groupBy).Msg("Failed to sum usage")
+		return total, err
+	}
+	return total, nil
+}
+
+// SQL for the UTC date (YYYY-MM-DD) of a timestamp column
+func (s *SQLStore) dayExpression(column string) string {
+	if s.dialect == "postgres" {
+		return "to_char(" + column + " AT TIME ZONE 'UTC', 'YYYY-MM-DD')"
+	}
+	// the SQLite driver saves timestamps as text starting with the date, and SaveChat saves them in UTC
+	return "substr(" + column + ", 1, 10)"
+}
+
+// generation parameters are stored as JSON, NULL when the provider's defaults were used
+func encodeParameters(params *models.GenerationParams) (sql.NullString, error) {
+	if params == nil {
+		return sql.NullString{}, nil
+	}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(encoded), Valid: true}, nil
+}
+
+func decodeParameters(value sql.NullString) (*models.GenerationParams, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	var params models.GenerationParams
+	if err := json.Unmarshal([]byte(value.String), &params); err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+const apiKeyColumns = "id, name, prefix, hash, scopes, created_at, expires_at, revoked_at"
+
+func (s *SQLStore) CreateAPIKey(ctx context.Context, key models.APIKey) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().
+		Str("keyID", key.ID.Hex()).
+		Str("name", key.Name).
+		Msg("Creating API key")
+
+	_, err := s.database.ExecContext(ctx,
+		"INSERT INTO api_keys ("+apiKeyColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		key.ID.Hex(), key.Name, key.Prefix, key.Hash, strings.Join(key.Scopes, ","), key.CreatedAt.UTC(), nullTime(key.ExpiresAt), nullTime(key.RevokedAt),
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to create API key")
+	}
+	return err
+}
+
+func (s *SQLStore) GetAPIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	key, err := scanAPIKey(s.database.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE hash = $1", hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to look up API key")
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *SQLStore) ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	rows, err := s.database.QueryContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys ORDER BY created_at DESC, id DESC")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to list API keys")
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to decode API keys")
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLStore) RevokeAPIKey(ctx context.Context, keyID string, at time.Time) (*models.APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	log.Debug().Str("keyID", keyID).Msg("Revoking API key")
+
+	_, err := s.database.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $1) WHERE id = $2",
+		at.UTC(), keyID,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to revoke API key")
+		return nil, err
+	}
+
+	key, err := scanAPIKey(s.database.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE id = $1", keyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+// scan an API key row selected with apiKeyColumns
+func scanAPIKey(row interface{ Scan(...any) error }) (*models.APIKey, error) {
+	var (
+		key                  models.APIKey
+		id, scopes           string
+		expiresAt, revokedAt sql.NullTime
+	)
+	if err := row.Scan(&id, &key.Name, &key.Prefix, &key.Hash, &scopes, &key.CreatedAt, &expiresAt, &revokedAt); err != nil {
+		return nil, err
+	}
+	var err error
+	if key.ID, err = primitive.ObjectIDFromHex(id); err != nil {
+		return nil, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	if expiresAt.Valid {
+		key.ExpiresAt = &expiresAt.Time
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return &key, nil
+}
+
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	_ "modernc.org/sqlite"
+)
+
+// open (or create) a SQLite database file and return a store backed by it, ":memory:" keeps it in process memory
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	dsn := path
+	if !strings.HasPrefix(dsn, "file:") && dsn != ":memory:" {
+		dsn = "file:" + dsn
+	}
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	dsn += separator + "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+	database, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, and an in-memory database only lives as long as its connection
+	database.SetMaxOpenConns(1)
+
+	if err := database.Ping(); err != nil {
+		database.Close()
+		log.Error().Err(err).Str("path", path).Msg("Failed to open SQLite database")
+		return nil, err
+	}
+
+	store, err := newSQLStore(database, "sqlite")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to migrate SQLite database")
+		return nil, err
+	}
+
+	log.Info().Str("path", path).Msg("SQLite database opened")
+	return store, nil
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go-bot/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrConversationNotFound = errors.New("conversation not found")
+
+// ChatStore persists chat messages and the conversations they belong to, every call is bound by the
+// caller's context so deadlines and cancellation of the incoming request reach the database
+type ChatStore interface {
+	// start a conversation of the user through the API key, empty when made without one
+	CreateConversation(ctx context.Context, userID, apiKeyID, title string) (*models.Conversation, error)
+	GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error)
+	// list the conversations of a user, most recently active first
+	ListConversations(ctx context.Context, userID string, includeArchived bool) ([]models.Conversation, error)
+	UpdateConversation(ctx context.Context, conversationID string, update models.ConversationUpdate) (*models.Conversation, error)
+	// delete a conversation together with all of its messages
+	DeleteConversation(ctx context.Context, conversationID string) error
+
+	// save an exchange, the ID and timestamp are filled in when empty
+	SaveChat(ctx context.Context, chat models.ChatMessage) error
+	// return the newest messages of a conversation, oldest first
+	GetChatHistory(ctx context.Context, conversationID string, limit int) ([]models.ChatMessage, error)
+	// sum the token usage of the messages saved in [from, to) per user and UTC day, ordered by day and user.
+	// Only the given user is counted unless userID is empty.
+	GetDailyUsage(ctx context.Context, userID string, from, to time.Time) ([]models.DailyUsage, error)
+	// sum the token usage and cost of the messages saved in [from, to) per user, API key or model
+	// (models.UsageGroup*), most expensive first
+	SumUsage(ctx context.Context, from, to time.Time, groupBy string) ([]models.UsageTotal, error)
+	// sum the token usage and cost of the messages saved in [from, to) by one user, API key or model
+	GetUsageTotal(ctx context.Context, groupBy, group string, from, to time.Time) (models.UsageTotal, error)
+
+	// managed API keys live next to the chats
+	APIKeyStore
+
+	IsConnected() bool
+	Disconnect() error
+}
+
+// column or field holding the group of a usage report
+func usageGroupField(groupBy string) (string, error) {
+	switch groupBy {
+	case models.UsageGroupUser:
+		return "user_id", nil
+	case models.UsageGroupKey:
+		return "api_key_id", nil
+	case models.UsageGroupModel:
+		return "model", nil
+	default:
+		return "", fmt.Errorf("unknown usage grouping %q", groupBy)
+	}
+}
+
+// order usage totals most expensive first, ties by group
+func sortUsageTotals(totals []models.UsageTotal) {
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Cost != totals[j].Cost {
+			return totals[i].Cost > totals[j].Cost
+		}
+		return totals[i].Group < totals[j].Group
+	})
+}
+
+// assign an ID and timestamp to a chat about to be saved
+func fillChatDefaults(chat *models.ChatMessage) {
+	if chat.ID.IsZero() {
+		chat.ID = primitive.NewObjectID()
+	}
+	if chat.Timestamp.IsZero() {
+		chat.Timestamp = time.Now()
+	}
+}
+
+// open the store selected by backend name
+func NewStore(backend, mongoURI, sqlitePath, postgresDSN string) (ChatStore, error) {
+	switch backend {
+	case "mongo":
+		return NewMongoStore(mongoURI)
+	case "sqlite":
+		return NewSQLiteStore(sqlitePath)
+	case "postgres":
+		return NewPostgresStore(postgresDSN)
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// scopes an API key can be granted
+const (
+	APIKeyScopeChat   = "chat"   // complete answers and manage conversations
+	APIKeyScopeStream = "stream" // streamed answers, over SSE and WebSocket
+	APIKeyScopeAdmin  = "admin"  // usage reports and key management
+)
+
+// API key is a managed key, only its hash is stored and the key itself is shown once when created
+type APIKey struct {
+	ID        primitive.ObjectID `bson:"_id" json:"id"`
+	Name      string             `bson:"name" json:"name" example:"billing-service"`                                      // What the key is used for
+	Prefix    string             `bson:"prefix" json:"prefix" example:"gb_3f9a1c27"`                                      // Start of the key, to recognize it by
+	Hash      string             `bson:"hash" json:"-"`                                                                   // SHA-256 of the key, hex encoded
+	Scopes    []string           `bson:"scopes" json:"scopes"`                                                            // What the key may be used for
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`                                                    // When the key was created
+	ExpiresAt *time.Time         `bson:"expires_at,omitempty" json:"expires_at,omitempty"`                                // When the key stops working, never when unset
+	RevokedAt *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty" example:"2026-01-02T15:04:05Z"` // When the key was revoked
+}
+
+func (k APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// whether the key may be used at the given time
+func (k APIKey) Active(at time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || at.Before(*k.ExpiresAt))
+}
+
+// API key request is the body of a key creation request
+type APIKeyRequest struct {
+	Name      string     `json:"name" example:"billing-service"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at" example:"2027-01-01T00:00:00Z"` // Never expires when unset
+}
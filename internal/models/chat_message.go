@@ -7,15 +7,31 @@ import (
 )
 
 type ChatMessage struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`    // MongoDB ObjectID
-	UserID    string             `bson:"user_id" json:"user_id"`     // The ID of the user sending the message
-	Message   string             `bson:"message" json:"message"`     // The user's message
-	Response  string             `bson:"response" json:"response"`   // The AI's response
-	Timestamp time.Time          `bson:"timestamp" json:"timestamp"` // Timestamp of the message
+	ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`                            // MongoDB ObjectID
+	UserID         string             `bson:"user_id" json:"user_id"`                             // The ID of the user sending the message
+	ConversationID string             `bson:"conversation_id" json:"conversation_id"`             // The conversation the message belongs to
+	Message        string             `bson:"message" json:"message"`                             // The user's message
+	Response       string             `bson:"response" json:"response"`                           // The AI's response
+	Timestamp      time.Time          `bson:"timestamp" json:"timestamp"`                         // Timestamp of the message
+	Interrupted    bool               `bson:"interrupted,omitempty" json:"interrupted,omitempty"` // The response was cut short by the client leaving or a provider error
+	Provider       string             `bson:"provider,omitempty" json:"provider,omitempty"`       // The LLM provider that answered, e.g. openai
+	Model          string             `bson:"model,omitempty" json:"model,omitempty"`             // The model that answered
+	Parameters     *GenerationParams  `bson:"parameters,omitempty" json:"parameters,omitempty"`   // The generation parameters the answer was requested with
+	Usage          Usage              `bson:"usage" json:"usage"`                                 // The tokens of the exchange, as reported by the provider or estimated
+	Cost           float64            `bson:"cost" json:"cost"`                                   // The price of the exchange in USD, zero for models without a price
+	APIKeyID       string             `bson:"api_key_id,omitempty" json:"api_key_id,omitempty"`   // The API key the exchange was requested with
 }
 
 // chat req represents incoming chat request from the client
 type ChatRequest struct {
-	UserID  string `json:"user_id" example:"12345"`                     // The user ID making the request
-	Message string `json:"message" binding:"required" example:"Hello!"` // The message from the user
+	UserID         string `json:"user_id" example:"12345"`                            // The user ID making the request
+	ConversationID string `json:"conversation_id" example:"65a1f0c2e4b0a1b2c3d4e5f6"` // The conversation to continue, a new one is started when empty
+	Message        string `json:"message" binding:"required" example:"Hello!"`        // The message from the user
+	Model          string `json:"model" example:"gpt-4o"`                             // The model to answer with, one of the allowed models, the default when empty
+
+	// The sampling parameters of the answer, the provider's defaults when unset
+	GenerationParams
+
+	// The standing against the quota closest to its limit, set while the request is processed
+	Quota *QuotaStatus `json:"-"`
 }
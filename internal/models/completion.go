@@ -0,0 +1,93 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// completion request is an OpenAI-compatible chat completion request, fields this service does not use are ignored
+type CompletionRequest struct {
+	Model         string              `json:"model"`                    // one of the allowed models, the default one answers when empty
+	Messages      []CompletionMessage `json:"messages"`                 // whole conversation, sent to the provider as-is
+	Stream        bool                `json:"stream"`                   // stream chat.completion.chunk events
+	StreamOptions *StreamOptions      `json:"stream_options,omitempty"` // streaming only
+	User          string              `json:"user"`                     // user the exchange is saved for, generated when empty
+
+	// sampling parameters, max_completion_tokens is the newer name of max_tokens and only used when max_tokens is unset
+	GenerationParams
+	MaxCompletionTokens *int `json:"max_completion_tokens,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // send a final chunk with the token usage
+}
+
+// completion message is a chat turn in the OpenAI format
+type CompletionMessage struct {
+	Role    string            `json:"role"`
+	Content CompletionContent `json:"content"`
+}
+
+// completion content is the text of a message, sent either as a string or as a list of content parts
+type CompletionContent string
+
+func (c *CompletionContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = CompletionContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New("content must be a string or a list of content parts")
+	}
+
+	// only text parts can be forwarded to every provider
+	var texts []string
+	for _, part := range parts {
+		if part.Type != "text" {
+			return errors.New("only text content parts are supported")
+		}
+		texts = append(texts, part.Text)
+	}
+	*c = CompletionContent(strings.Join(texts, "\n"))
+	return nil
+}
+
+// completion response is a chat.completion object, or a chat.completion.chunk when streaming
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Index        int                `json:"index"`
+	Message      *CompletionMessage `json:"message,omitempty"` // complete answers
+	Delta        *CompletionDelta   `json:"delta,omitempty"`   // streamed chunks
+	FinishReason *string            `json:"finish_reason"`     // null until the answer ends
+}
+
+type CompletionDelta struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// completion error is the error body of the OpenAI API
+type CompletionError struct {
+	Error CompletionErrorDetail `json:"error"`
+}
+
+type CompletionErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Code    *string `json:"code"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Conversation struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`                          // MongoDB ObjectID
+	UserID    string             `bson:"user_id" json:"user_id"`                           // The user owning the conversation
+	APIKeyID  string             `bson:"api_key_id,omitempty" json:"api_key_id,omitempty"` // The API key that started the conversation, the only one with access
+	Title     string             `bson:"title" json:"title"`                               // Short title, defaults to the first message
+	Archived  bool               `bson:"archived" json:"archived"`                         // Hidden from the default listing
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`                     // Timestamp of the first message
+	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`                     // Timestamp of the latest message
+}
+
+// conversation update represents a partial update of a conversation, nil fields are left unchanged
+type ConversationUpdate struct {
+	Title    *string `json:"title" example:"Trip planning"` // New title of the conversation
+	Archived *bool   `json:"archived" example:"true"`       // Archive or restore the conversation
+}
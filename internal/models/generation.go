@@ -0,0 +1,38 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// generation params tune how an answer is sampled, unset fields leave the provider's defaults
+type GenerationParams struct {
+	Temperature *float64      `bson:"temperature,omitempty" json:"temperature,omitempty" example:"0.7"` // randomness, 0 to 2
+	TopP        *float64      `bson:"top_p,omitempty" json:"top_p,omitempty" example:"1"`               // nucleus sampling mass, 0 to 1
+	MaxTokens   *int          `bson:"max_tokens,omitempty" json:"max_tokens,omitempty" example:"512"`   // cap on the tokens of the answer
+	Stop        StopSequences `bson:"stop,omitempty" json:"stop,omitempty"`                             // sequences ending the answer when generated
+	Seed        *int64        `bson:"seed,omitempty" json:"seed,omitempty" example:"42"`                // best-effort deterministic sampling, where supported
+}
+
+// whether no parameter is set
+func (p GenerationParams) IsZero() bool {
+	return p.Temperature == nil && p.TopP == nil && p.MaxTokens == nil && len(p.Stop) == 0 && p.Seed == nil
+}
+
+// stop sequences are sent either as a single string or as a list of strings
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var sequence string
+	if err := json.Unmarshal(data, &sequence); err == nil {
+		*s = StopSequences{sequence}
+		return nil
+	}
+
+	var sequences []string
+	if err := json.Unmarshal(data, &sequences); err != nil {
+		return errors.New("stop must be a string or a list of strings")
+	}
+	*s = sequences
+	return nil
+}
@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// quota limits cap what a user or API key may use, a zero limit is off
+type QuotaLimits struct {
+	DailyTokens   int
+	MonthlyTokens int
+	DailyCost     float64 // USD
+	MonthlyCost   float64 // USD
+}
+
+// whether no limit is set
+func (l QuotaLimits) IsZero() bool {
+	return l == QuotaLimits{}
+}
+
+// periods and units of a quota, quotas are scoped like usage reports (UsageGroupUser or UsageGroupKey)
+const (
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodMonthly = "monthly"
+
+	QuotaUnitTokens = "tokens"
+	QuotaUnitUSD    = "usd"
+)
+
+// quota status is the standing of a user or API key against one of its quotas
+type QuotaStatus struct {
+	Scope   string // UsageGroupUser or UsageGroupKey
+	Period  string // QuotaPeriodDaily or QuotaPeriodMonthly
+	Unit    string // QuotaUnitTokens or QuotaUnitUSD
+	Limit   float64
+	Used    float64
+	Reset   time.Time // when the period ends and the quota is available again
+	Warning bool      // past the soft limit
+}
+
+// what is left of the quota, zero once exceeded
+func (s QuotaStatus) Remaining() float64 {
+	return max(s.Limit-s.Used, 0)
+}
+
+// name of the quota for messages, e.g. "daily token quota"
+func (s QuotaStatus) Describe() string {
+	unit := "token"
+	if s.Unit == QuotaUnitUSD {
+		unit = "spend"
+	}
+	return s.Period + " " + unit + " quota"
+}
+
+func (s QuotaStatus) Exceeded() bool {
+	return s.Used >= s.Limit
+}
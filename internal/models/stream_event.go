@@ -0,0 +1,27 @@
+package models
+
+// stream event types sent to the client, in order: start, delta..., usage, then error and/or done
+const (
+	StreamEventStart = "start"
+	StreamEventDelta = "delta"
+	StreamEventUsage = "usage"
+	StreamEventError = "error"
+	StreamEventDone  = "done"
+)
+
+// stream event is a single server-sent event of a streamed answer, sent as JSON in the data field
+type StreamEvent struct {
+	ID             int    `json:"id"`                        // position of the event in its stream, starting at 1, sent as the SSE event ID
+	Type           string `json:"type"`                      // one of the StreamEvent* types
+	UserID         string `json:"user_id,omitempty"`         // start: the user owning the conversation
+	ConversationID string `json:"conversation_id,omitempty"` // start: the conversation the answer belongs to
+	MessageID      string `json:"message_id,omitempty"`      // start: ID the exchange is saved under
+	Provider       string `json:"provider,omitempty"`        // start: provider generating the answer
+	Model          string `json:"model,omitempty"`           // start: model generating the answer
+	Index          *int   `json:"index,omitempty"`           // delta: position of the chunk, starting at 0
+	Text           string `json:"text,omitempty"`            // delta: raw text of the chunk, whitespace included
+	Usage          *Usage `json:"usage,omitempty"`           // usage: token counts of the exchange
+	Error          string `json:"error,omitempty"`           // error: description of the failure
+	Code           string `json:"code,omitempty"`            // error: machine-readable reason, e.g. rate_limited
+	FinishReason   string `json:"finish_reason,omitempty"`   // done: stop, length, error or cancelled
+}
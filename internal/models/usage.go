@@ -0,0 +1,38 @@
+package models
+
+// token counts of an exchange
+type Usage struct {
+	PromptTokens     int `bson:"prompt_tokens" json:"prompt_tokens"`         // tokens sent to the model, including history
+	CompletionTokens int `bson:"completion_tokens" json:"completion_tokens"` // tokens of the answer
+	TotalTokens      int `bson:"total_tokens" json:"total_tokens"`           // sum of both
+}
+
+// daily usage is the token usage of a user on a single day
+type DailyUsage struct {
+	UserID   string  `bson:"user_id" json:"user_id"`
+	Day      string  `bson:"day" json:"day"`           // UTC date, YYYY-MM-DD
+	Messages int     `bson:"messages" json:"messages"` // exchanges saved that day
+	Cost     float64 `bson:"cost" json:"cost"`         // USD
+	Usage    `bson:",inline"`
+}
+
+// groupings of a usage report
+const (
+	UsageGroupUser  = "user"
+	UsageGroupKey   = "key"
+	UsageGroupModel = "model"
+)
+
+// usage total is the summed usage of one group of a usage report
+type UsageTotal struct {
+	Group    string  `bson:"group" json:"group"`       // user ID, API key ID or model, depending on the grouping
+	Messages int     `bson:"messages" json:"messages"` // exchanges saved in the period
+	Cost     float64 `bson:"cost" json:"cost"`         // USD
+	Usage    `bson:",inline"`
+}
+
+// model price is what a model costs in USD per million tokens
+type ModelPrice struct {
+	Input  float64 `json:"input"`  // prompt tokens
+	Output float64 `json:"output"` // completion tokens
+}
@@ -0,0 +1,26 @@
+package models
+
+// control frame types a client sends over the WebSocket connection
+const (
+	WSFrameMessage            = "message"             // send a user message and stream the answer back
+	WSFrameCancel             = "cancel"              // stop the answer being generated
+	WSFramePing               = "ping"                // answered with a pong frame
+	WSFrameSwitchConversation = "switch_conversation" // continue another conversation, or a new one when the ID is empty
+)
+
+// frame types the server sends besides the stream events
+const (
+	WSFramePong         = "pong"
+	WSFrameConversation = "conversation" // acknowledges a switch_conversation frame
+)
+
+// WS client frame is a JSON frame received from a WebSocket client
+type WSClientFrame struct {
+	Type           string `json:"type"`                      // one of the WSFrame* client types
+	Message        string `json:"message,omitempty"`         // message: the user's message
+	Model          string `json:"model,omitempty"`           // message: model to answer with, the default when empty
+	ConversationID string `json:"conversation_id,omitempty"` // switch_conversation: conversation to continue
+
+	// message: sampling parameters of the answer
+	GenerationParams
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryBackend counts requests in process memory, each instance of the service limits on its own
+type MemoryBackend struct {
+	mutex     sync.Mutex
+	counters  map[string]*counter
+	lastSweep time.Time
+}
+
+type counter struct {
+	start             time.Time
+	current, previous int64
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{counters: map[string]*counter{}}
+}
+
+func (b *MemoryBackend) Hit(ctx context.Context, key string, start time.Time, window time.Duration) (int64, int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.sweep(start, window)
+
+	c, ok := b.counters[key]
+	switch {
+	case !ok:
+		c = &counter{start: start}
+		b.counters[key] = c
+	case c.start.Equal(start):
+	case c.start.Add(window).Equal(start):
+		c.start, c.previous, c.current = start, c.current, 0
+	default:
+		c.start, c.previous, c.current = start, 0, 0
+	}
+	c.current++
+	return c.current, c.previous, nil
+}
+
+// drop the counters of clients idle for more than a window, at most once per window
+func (b *MemoryBackend) sweep(start time.Time, window time.Duration) {
+	if start.Sub(b.lastSweep) < window {
+		return
+	}
+	b.lastSweep = start
+	for key, c := range b.counters {
+		if c.start.Add(window).Before(start) {
+			delete(b.counters, key)
+		}
+	}
+}
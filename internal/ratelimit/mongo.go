@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoBackend counts requests in a MongoDB collection, so every instance of the service shares the limits
+type MongoBackend struct {
+	client     *mongo.Client
+	collection *mongo.Collection
+}
+
+// a counter document, removed by a TTL index once its window no longer matters
+type mongoCounter struct {
+	ID       string    `bson:"_id"` // key and window start
+	Count    int64     `bson:"count"`
+	ExpireAt time.Time `bson:"expire_at"`
+}
+
+// connect to MongoDB and return a backend keeping its counters in the rateLimits collection
+func NewMongoBackend(mongoURI string) (*MongoBackend, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	clientOptions := options.Client().
+		ApplyURI(mongoURI).
+		SetMaxPoolSize(5).
+		SetServerSelectionTimeout(5 * time.Second).
+		SetConnectTimeout(5 * time.Second).
+		SetSocketTimeout(5 * time.Second).
+		SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	collection := client.Database("go-chat-backend").Collection("rateLimits")
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expire_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to create rate limit expiry index")
+	}
+	return &MongoBackend{client: client, collection: collection}, nil
+}
+
+func (b *MongoBackend) Hit(ctx context.Context, key string, start time.Time, window time.Duration) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	var current mongoCounter
+	err := b.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": counterID(key, start)},
+		bson.M{
+			"$inc":         bson.M{"count": 1},
+			"$setOnInsert": bson.M{"expire_at": start.Add(2 * window)},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&current)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var previous mongoCounter
+	err = b.collection.FindOne(ctx, bson.M{"_id": counterID(key, start.Add(-window))}).Decode(&previous)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, 0, err
+	}
+	return current.Count, previous.Count, nil
+}
+
+func (b *MongoBackend) Disconnect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return b.client.Disconnect(ctx)
+}
+
+func counterID(key string, start time.Time) string {
+	return key + "@" + strconv.FormatInt(start.Unix(), 10)
+}
@@ -0,0 +1,107 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Backend counts the requests made under a key in fixed windows, shared by every instance using it
+type Backend interface {
+	// count a request in the window of key starting at start, returning the requests of that window
+	// so far and of the window before it
+	Hit(ctx context.Context, key string, start time.Time, window time.Duration) (current, previous int64, err error)
+}
+
+// Rules are the requests allowed per window for each kind of client, a zero limit is off
+type Rules struct {
+	Window  time.Duration
+	PerKey  int // per API key
+	PerUser int // per user ID
+	PerIP   int // per client IP
+}
+
+// Subject is who a request is counted against, empty fields are not limited
+type Subject struct {
+	KeyID  string
+	UserID string
+	IP     string
+}
+
+// Result is the standing of a request against the limit closest to being reached
+type Result struct {
+	Allowed   bool
+	Scope     string // "key", "user" or "ip"
+	Limit     int
+	Remaining int
+	Reset     time.Duration // until the current window ends
+}
+
+// Limiter applies sliding window limits: the requests of the current window are added to those of the
+// previous one, weighted by how much of it still overlaps the sliding window. Rejected requests count too,
+// so a client has to back off for its requests to get through again.
+type Limiter struct {
+	backend Backend
+	rules   Rules
+	now     func() time.Time
+}
+
+func NewLimiter(backend Backend, rules Rules) *Limiter {
+	if rules.Window <= 0 {
+		rules.Window = time.Minute
+	}
+	return &Limiter{backend: backend, rules: rules, now: time.Now}
+}
+
+// count a request against every limit of its subject, nil when none applies. Callers should let the request
+// through when the backend fails, an unavailable limiter should not take the service down with it.
+func (l *Limiter) Allow(ctx context.Context, subject Subject) (*Result, error) {
+	checks := []struct {
+		scope, id string
+		limit     int
+	}{
+		{"key", subject.KeyID, l.rules.PerKey},
+		{"user", subject.UserID, l.rules.PerUser},
+		{"ip", subject.IP, l.rules.PerIP},
+	}
+
+	now := l.now()
+	start := now.Truncate(l.rules.Window)
+	elapsed := now.Sub(start)
+
+	var tightest *Result
+	for _, check := range checks {
+		if check.id == "" || check.limit <= 0 {
+			continue
+		}
+		current, previous, err := l.backend.Hit(ctx, check.scope+":"+check.id, start, l.rules.Window)
+		if err != nil {
+			log.Error().Err(err).Str("scope", check.scope).Msg("Rate limit backend failed, request let through")
+			return nil, err
+		}
+
+		overlap := float64(l.rules.Window-elapsed) / float64(l.rules.Window)
+		used := int(math.Ceil(float64(previous)*overlap)) + int(current)
+		result := Result{
+			Allowed:   used <= check.limit,
+			Scope:     check.scope,
+			Limit:     check.limit,
+			Remaining: max(check.limit-used, 0),
+			Reset:     l.rules.Window - elapsed,
+		}
+		if tightest == nil || result.Tighter(*tightest) {
+			tightest = &result
+		}
+	}
+	return tightest, nil
+}
+
+// whether r is closer to its limit than other, a rejection always is
+func (r Result) Tighter(other Result) bool {
+	if r.Allowed != other.Allowed {
+		return !r.Allowed
+	}
+	return float64(r.Remaining)/float64(r.Limit) < float64(other.Remaining)/float64(other.Limit)
+}
@@ -0,0 +1,273 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go-bot/internal/models"
+	"go-bot/internal/util"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 4096
+
+	anthropicMaxTemperature = 1.0
+)
+
+// structure of the Anthropic Messages API request payload
+type AnthropicRequestPayload struct {
+	Model     string    `json:"model"`            // Anthropic model to use
+	System    string    `json:"system,omitempty"` // system prompt, kept outside of messages
+	Messages  []Message `json:"messages"`         // alternating user and assistant turns
+	MaxTokens int       `json:"max_tokens"`       // required by the Messages API
+	Stream    bool      `json:"stream,omitempty"` // flag for streaming responses
+
+	Temperature   *float64 `json:"temperature,omitempty"` // sampling parameters, the API defaults when unset
+	TopP          *float64 `json:"top_p,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+}
+
+// structure of response body from the Anthropic Messages API
+type AnthropicResponseBody struct {
+	Content []struct {
+		Type string `json:"type"` // block type, only "text" carries content
+		Text string `json:"text"` // content of the block
+	} `json:"content"`
+	StopReason string         `json:"stop_reason"`
+	Usage      AnthropicUsage `json:"usage"`
+}
+
+// token counts of an Anthropic answer
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// structure of a streamed event from the Anthropic Messages API
+type AnthropicStreamEvent struct {
+	Type  string `json:"type"` // e.g. content_block_delta, message_stop
+	Delta struct {
+		Type       string `json:"type"` // text_delta for content chunks
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"` // set on message_delta events
+	} `json:"delta"`
+	Message struct {
+		Usage AnthropicUsage `json:"usage"` // input tokens, set on message_start events
+	} `json:"message"`
+	Usage AnthropicUsage `json:"usage"` // output tokens so far, set on message_delta events
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// provider for the Anthropic Messages API
+type AnthropicProvider struct {
+	baseURL string
+	apiKey  string
+	model   string
+}
+
+func NewAnthropicProvider(baseURL, apiKey, model string) *AnthropicProvider {
+	return &AnthropicProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
+	}
+}
+
+func (p *AnthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (p *AnthropicProvider) Model() string {
+	return p.model
+}
+
+// the Messages API requires max_tokens, this many are asked for when the request sets none
+func (p *AnthropicProvider) DefaultMaxTokens() int {
+	return anthropicMaxTokens
+}
+
+// construct payload for the Messages API, system turns are moved to the top-level field
+// seeds are not supported by the Messages API and are left out
+func (p *AnthropicProvider) buildPayload(messages []Message, params models.GenerationParams, stream bool) AnthropicRequestPayload {
+	payload := AnthropicRequestPayload{
+		Model:         p.model,
+		MaxTokens:     anthropicMaxTokens,
+		Stream:        stream,
+		TopP:          params.TopP,
+		StopSequences: params.Stop,
+	}
+	if params.MaxTokens != nil {
+		payload.MaxTokens = *params.MaxTokens
+	}
+	if params.Temperature != nil {
+		// the Messages API only accepts temperatures up to 1
+		temperature := min(*params.Temperature, anthropicMaxTemperature)
+		payload.Temperature = &temperature
+	}
+
+	var system []string
+	for _, message := range messages {
+		if message.Role == "system" {
+			system = append(system, message.Content)
+			continue
+		}
+		payload.Messages = append(payload.Messages, message)
+	}
+	payload.System = strings.Join(system, "\n\n")
+
+	log.Debug().Interface("payload", payload).Msg("Constructed Anthropic payload")
+	return payload
+}
+
+// translate an Anthropic stop reason to the OpenAI finish reasons used across providers
+func anthropicFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "length"
+	case "":
+		return ""
+	default:
+		return "stop"
+	}
+}
+
+func (p *AnthropicProvider) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         p.apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+}
+
+// send request to the Messages API and return the text of the response
+func (p *AnthropicProvider) Complete(ctx context.Context, messages []Message, params models.GenerationParams) (*Completion, error) {
+	payload := p.buildPayload(messages, params, false)
+
+	log.Debug().Msg("Sending request to Anthropic API")
+	resp, err := sendWithRetry(ctx, p.Name(), func() (*http.Response, error) {
+		return util.SendJSONRequest(ctx, p.baseURL+"/messages", p.headers(), payload, false)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to call Anthropic API")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	log.Debug().Int("status_code", resp.StatusCode).Msg("Received response from Anthropic API")
+
+	var responseBody AnthropicResponseBody
+	if err := json.NewDecoder(resp.Body).Decode(&responseBody); err != nil {
+		log.Error().Err(err).Msg("Failed to decode Anthropic API response")
+		return nil, err
+	}
+
+	var content strings.Builder
+	for _, block := range responseBody.Content {
+		if block.Type == "text" {
+			content.WriteString(block.Text)
+		}
+	}
+
+	if content.Len() > 0 {
+		log.Debug().Str("response_content", content.String()).Msg("Anthropic response content")
+		return &Completion{
+			Text:         content.String(),
+			FinishReason: anthropicFinishReason(responseBody.StopReason),
+			Usage:        reportedUsage(responseBody.Usage.InputTokens, responseBody.Usage.OutputTokens),
+		}, nil
+	}
+
+	log.Error().Msg("No response content from Anthropic API")
+	return nil, errors.New("no response content from Anthropic API")
+}
+
+// stream the response of the Messages API as content chunks
+func (p *AnthropicProvider) Stream(ctx context.Context, messages []Message, params models.GenerationParams) (<-chan StreamChunk, error) {
+	payload := p.buildPayload(messages, params, true)
+
+	resp, err := sendWithRetry(ctx, p.Name(), func() (*http.Response, error) {
+		return util.SendJSONRequest(ctx, p.baseURL+"/messages", p.headers(), payload, true)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send streaming request to Anthropic")
+		return nil, err
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer func() {
+			resp.Body.Close()
+			close(chunks)
+		}()
+
+		// input tokens come with the first event, output tokens with the last
+		var inputTokens int
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			// the event type is repeated in the data payload, so "event:" lines are skipped
+			if !strings.HasPrefix(line, "data:") {
+				continue
+			}
+			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+
+			var event AnthropicStreamEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				log.Error().Err(err).Str("data", data).Msg("Failed to decode stream data")
+				continue
+			}
+
+			switch event.Type {
+			case "message_start":
+				inputTokens = event.Message.Usage.InputTokens
+			case "content_block_delta":
+				if event.Delta.Type == "text_delta" && event.Delta.Text != "" {
+					if !sendChunk(ctx, chunks, StreamChunk{Text: event.Delta.Text}) {
+						return
+					}
+				}
+			case "message_delta":
+				if !sendChunk(ctx, chunks, StreamChunk{Usage: reportedUsage(inputTokens, event.Usage.OutputTokens)}) {
+					return
+				}
+				if reason := anthropicFinishReason(event.Delta.StopReason); reason != "" {
+					if !sendChunk(ctx, chunks, StreamChunk{FinishReason: reason}) {
+						return
+					}
+				}
+			case "message_stop":
+				log.Debug().Msg("Stream completed")
+				return
+			case "error":
+				log.Error().
+					Str("error_type", event.Error.Type).
+					Str("error_message", event.Error.Message).
+					Msg("Anthropic stream returned an error")
+				sendChunk(ctx, chunks, StreamChunk{Err: streamError(p.Name(), event.Error.Type, event.Error.Message)})
+				return
+			}
+		}
+
+		if ctx.Err() != nil {
+			log.Debug().Msg("Stream cancelled by the client")
+			return
+		}
+		if err := scanner.Err(); err != nil {
+			log.Error().Err(err).Msg("Error reading streamed data")
+			sendChunk(ctx, chunks, StreamChunk{Err: err})
+		}
+	}()
+
+	return chunks, nil
+}
@@ -1,130 +1,347 @@
 package service
 
 import (
-	"bufio"
-	"encoding/json"
+	"cmp"
+	"context"
+	"errors"
+	"strings"
+
 	"go-bot/internal/db"
 	"go-bot/internal/models"
 	"go-bot/internal/util"
-	"strings"
 
 	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	systemPrompt = "You are a helpful assistant."
+
+	// maximum length in characters of a title derived from the first message
+	conversationTitleLength = 60
 )
 
-type ChatGPTStreamBody struct {
-	Choices []struct {
-		Delta struct {
-			Content string `json:"content"`
-		} `json:"delta"`
-	} `json:"choices"`
+// construct the conversation sent to the LLM provider
+func BuildMessages(userMessage string, history []models.ChatMessage, systemMessage string) []Message {
+	log.Debug().Str("userMessage", userMessage).Msg("Building messages")
+	log.Debug().Int("history_length", len(history)).Msg("Chat history length")
+	log.Debug().Str("systemMessage", systemMessage).Msg("System message used")
+
+	messages := []Message{
+		{Role: "system", Content: systemMessage},
+	}
+
+	// replay chat history as alternating user and assistant turns
+	for _, chat := range history {
+		messages = append(messages, exchangeMessages(chat)...)
+	}
+	messages = append(messages, Message{Role: "user", Content: userMessage})
+
+	return messages
 }
 
-// handle streaming requests from OpenAI API
-func ProcessStream(request models.ChatRequest) (<-chan string, error) {
-	if request.UserID == "" {
-		request.UserID = util.GenerateUserID()
-		log.Debug().Msgf("Generated UserID: %s", request.UserID)
+// turns of a stored exchange, the assistant turn is left out when there is no response
+func exchangeMessages(chat models.ChatMessage) []Message {
+	messages := []Message{{Role: "user", Content: chat.Message}}
+	if chat.Response != "" {
+		messages = append(messages, Message{Role: "assistant", Content: chat.Response})
 	}
+	return messages
+}
 
-	chatHistory, err := db.GetChatHistory(request.UserID, 3)
+// fill in the conversation of the request, starting a new one when none is given
+func resolveConversation(ctx context.Context, store db.ChatStore, request *models.ChatRequest) error {
+	if request.ConversationID == "" {
+		conversation, err := store.CreateConversation(ctx, request.UserID, util.APIKeyID(ctx), conversationTitle(request.Message))
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to create conversation")
+			return err
+		}
+		request.ConversationID = conversation.ID.Hex()
+		return nil
+	}
+
+	if _, err := GetConversation(ctx, request.UserID, request.ConversationID); err != nil {
+		log.Warn().
+			Err(err).
+			Str("userID", request.UserID).
+			Str("conversationID", request.ConversationID).
+			Msg("Conversation not available to user")
+		return err
+	}
+	return nil
+}
+
+// derive a conversation title from the first message
+func conversationTitle(message string) string {
+	title := strings.Join(strings.Fields(message), " ")
+	if runes := []rune(title); len(runes) > conversationTitleLength {
+		title = strings.TrimSpace(string(runes[:conversationTitleLength])) + "…"
+	}
+	return title
+}
+
+// handle streaming requests through the configured provider, the request is updated with the resolved user and conversation IDs.
+// The answer is delivered as a start event, delta events, a usage event and a done event, preceded by an error event when
+// the provider fails mid-stream. Events are buffered under the message ID from the start event so a client whose ctx ends
+// can pick up with ResumeStream; when none comes back within the resume window, the upstream call is aborted and the
+// partial response is saved as interrupted.
+func ProcessStream(ctx context.Context, request *models.ChatRequest) (<-chan models.StreamEvent, error) {
+	providers, store, err := chatBackends(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveConversation(ctx, store, request); err != nil {
+		return nil, err
+	}
+
+	chatHistory, err := store.GetChatHistory(ctx, request.ConversationID, historyFetchLimit)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to fetch chat history")
 		return nil, err
 	}
 
-	payload := BuildChatGPTPayload(request.Message, chatHistory, "You are a helpful assistant.")
-	payload.Stream = true
-	log.Debug().Interface("payload", payload).Msg("Payload for streaming request")
+	// the context is packed for the primary model, fallbacks are expected to fit at least as much
+	messages := BuildContext(providers[0].Model(), request.Message, chatHistory, systemPrompt, contextParams(providers[0], request.GenerationParams))
+	return streamAnswer(ctx, providers, store, request, messages)
+}
 
-	resp, err := util.SendOpenAIRequest(payload, true)
+// the parameters the context is packed for, with the max_tokens the provider sends when the request sets none
+func contextParams(provider Provider, params models.GenerationParams) models.GenerationParams {
+	if params.MaxTokens == nil {
+		if limited, ok := provider.(maxTokensDefaulter); ok {
+			maxTokens := limited.DefaultMaxTokens()
+			params.MaxTokens = &maxTokens
+		}
+	}
+	return params
+}
+
+// stream the first available provider's answer to messages through a resumable buffer and save it as the reply to request.Message
+func streamAnswer(ctx context.Context, providers []Provider, store db.ChatStore, request *models.ChatRequest, messages []Message) (<-chan models.StreamEvent, error) {
+	// generation outlives the client's request so it can reconnect, it keeps the request's values only
+	generationCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	provider, chunks, err := streamWithFallback(generationCtx, providers, messages, request.GenerationParams)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to send streaming request to OpenAI")
+		cancel()
+		log.Error().Err(err).Msg("Failed to start streaming request")
 		return nil, err
 	}
+	model := provider.Model()
 
-	streamChannel := make(chan string)
-	go func() {
-		defer func() {
-			resp.Body.Close()
-			close(streamChannel)
-		}()
+	// the ID is assigned up front so the client learns it from the start event
+	chat := models.ChatMessage{
+		ID:             primitive.NewObjectID(),
+		UserID:         request.UserID,
+		ConversationID: request.ConversationID,
+		Message:        request.Message,
+		Provider:       provider.Name(),
+		Model:          model,
+		Parameters:     storedParams(request.GenerationParams),
+		APIKeyID:       util.APIKeyID(ctx),
+	}
 
-		scanner := bufio.NewScanner(resp.Body)
-		var aggregatedResponse string
+	buffer := newStreamBuffer(chat.ID.Hex(), chat.UserID, chat.APIKeyID, cancel)
+	buffer.append(models.StreamEvent{
+		Type:           models.StreamEventStart,
+		UserID:         chat.UserID,
+		ConversationID: chat.ConversationID,
+		MessageID:      chat.ID.Hex(),
+		Provider:       chat.Provider,
+		Model:          model,
+	})
 
-		for scanner.Scan() {
-			line := scanner.Text()
+	go func() {
+		defer cancel()
+		defer buffer.finish()
 
-			if len(line) == 0 {
+		var (
+			aggregatedResponse strings.Builder
+			finishReason       string
+			reported           *models.Usage
+			streamErr          error
+			index              int
+		)
+		for chunk := range chunks {
+			if chunk.Err != nil {
+				streamErr = chunk.Err
 				continue
 			}
-
-			if !strings.HasPrefix(line, "data: ") {
+			if chunk.Usage != nil {
+				reported = chunk.Usage
 				continue
 			}
-
-			// remove "data: " prefix and trim spaces
-			data := strings.TrimSpace(line[6:])
-
-			// check for stream end
-			if data == "[DONE]" {
-				log.Debug().Msg("Stream completed")
-				break
-			}
-
-			var streamBody ChatGPTStreamBody
-			if err := json.Unmarshal([]byte(data), &streamBody); err != nil {
-				log.Error().Err(err).Str("data", data).Msg("Failed to decode stream data")
+			if chunk.FinishReason != "" {
+				finishReason = chunk.FinishReason
 				continue
 			}
 
-			// process content chunks
-			for _, choice := range streamBody.Choices {
-				content := choice.Delta.Content
-				if content != "" {
-					aggregatedResponse += content
-					streamChannel <- content
-				}
-			}
+			aggregatedResponse.WriteString(chunk.Text)
+			position := index
+			buffer.append(models.StreamEvent{Type: models.StreamEventDelta, Index: &position, Text: chunk.Text})
+			index++
 		}
 
-		if err := scanner.Err(); err != nil {
-			log.Error().Err(err).Msg("Error reading streamed data")
+		chat.Response = aggregatedResponse.String()
+		chat.Interrupted = generationCtx.Err() != nil || streamErr != nil
+		switch {
+		case generationCtx.Err() != nil:
+			finishReason = "cancelled"
+			log.Warn().
+				Str("conversationID", chat.ConversationID).
+				Int("partial_length", len(chat.Response)).
+				Msg("Stream cancelled, upstream request aborted")
+		case streamErr != nil:
+			finishReason = "error"
+			log.Error().Err(streamErr).Str("provider", provider.Name()).Msg("Provider stream failed")
+		case finishReason == "":
+			finishReason = "stop"
 		}
 
-		log.Debug().Str("aggregated_response", aggregatedResponse).Msg("Final aggregated response")
+		log.Debug().Str("aggregated_response", chat.Response).Msg("Final aggregated response")
 
-		if saveErr := db.SaveChat(request.UserID, request.Message, aggregatedResponse); saveErr != nil {
+		chat.Usage = resolveUsage(reported, model, messages, chat.Response)
+		chat.Cost = exchangeCost(model, chat.Usage)
+		if saveErr := store.SaveChat(context.WithoutCancel(generationCtx), chat); saveErr != nil {
 			log.Error().Err(saveErr).Msg("Failed to save chat to database")
 		}
+
+		buffer.append(models.StreamEvent{Type: models.StreamEventUsage, Usage: &chat.Usage})
+		if streamErr != nil {
+			errorEvent := models.StreamEvent{Type: models.StreamEventError, Error: "The answer could not be completed"}
+			var httpErr util.HTTPError
+			if errors.As(streamErr, &httpErr) {
+				errorEvent.Code = httpErr.ErrorCode()
+			}
+			buffer.append(errorEvent)
+		}
+		buffer.append(models.StreamEvent{Type: models.StreamEventDone, FinishReason: finishReason})
 	}()
 
-	return streamChannel, nil
+	return buffer.subscribe(ctx, 0), nil
 }
 
-// handle non-streaming chat requests
-func ProcessChat(request models.ChatRequest) (string, error) {
-	if request.UserID == "" {
-		request.UserID = util.GenerateUserID()
-		log.Debug().Msgf("Generated UserID: %s", request.UserID)
+// handle non-streaming chat requests, the request is updated with the resolved user and conversation IDs
+func ProcessChat(ctx context.Context, request *models.ChatRequest) (string, error) {
+	providers, store, err := chatBackends(ctx, request)
+	if err != nil {
+		return "", err
 	}
 
-	chatHistory, err := db.GetChatHistory(request.UserID, 3)
+	if err := resolveConversation(ctx, store, request); err != nil {
+		return "", err
+	}
+
+	chatHistory, err := store.GetChatHistory(ctx, request.ConversationID, historyFetchLimit)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to fetch chat history")
 		return "", err
 	}
 
-	payload := BuildChatGPTPayload(request.Message, chatHistory, "You are a helpful assistant.")
-	response, err := CallOpenAI(payload)
+	messages := BuildContext(providers[0].Model(), request.Message, chatHistory, systemPrompt, contextParams(providers[0], request.GenerationParams))
+	result, err := completeAnswer(ctx, providers, store, request, messages)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to get response from OpenAI")
 		return "", err
 	}
+	return result.Response, nil
+}
+
+// result of a non-streamed answer
+type ChatResult struct {
+	MessageID    string
+	Provider     string // provider of the fallback chain that answered
+	Model        string
+	Response     string
+	FinishReason string
+	Usage        models.Usage
+}
 
-	if saveErr := db.SaveChat(request.UserID, request.Message, response); saveErr != nil {
+// ask the first available provider to answer messages and save the answer as the reply to request.Message
+func completeAnswer(ctx context.Context, providers []Provider, store db.ChatStore, request *models.ChatRequest, messages []Message) (*ChatResult, error) {
+	provider, completion, err := completeWithFallback(ctx, providers, messages, request.GenerationParams)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get response from provider")
+		return nil, err
+	}
+
+	chat := models.ChatMessage{
+		ID:             primitive.NewObjectID(),
+		UserID:         request.UserID,
+		ConversationID: request.ConversationID,
+		Message:        request.Message,
+		Response:       completion.Text,
+		Provider:       provider.Name(),
+		Model:          provider.Model(),
+		Parameters:     storedParams(request.GenerationParams),
+		Usage:          resolveUsage(completion.Usage, provider.Model(), messages, completion.Text),
+		APIKeyID:       util.APIKeyID(ctx),
+	}
+	chat.Cost = exchangeCost(chat.Model, chat.Usage)
+	// the answer is paid for by now, so it is saved with its usage even when the client has gone
+	if saveErr := store.SaveChat(context.WithoutCancel(ctx), chat); saveErr != nil {
 		log.Error().Err(saveErr).Msg("Failed to save chat to database")
 	}
 
-	return response, nil
+	return &ChatResult{
+		MessageID:    chat.ID.Hex(),
+		Provider:     chat.Provider,
+		Model:        chat.Model,
+		Response:     chat.Response,
+		FinishReason: cmp.Or(completion.FinishReason, "stop"),
+		Usage:        chat.Usage,
+	}, nil
+}
+
+// token counts of an answer, those reported by the backend when it did and estimates otherwise
+func resolveUsage(reported *models.Usage, model string, messages []Message, response string) models.Usage {
+	if reported == nil {
+		return estimateUsage(model, messages, response)
+	}
+	usage := *reported
+	// Ollama leaves out the prompt tokens when the prompt was cached
+	if usage.PromptTokens == 0 {
+		usage.PromptTokens = CountMessageTokens(model, messages)
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	return usage
+}
+
+// token counts estimated with the model's tokenizer, for backends that report none
+func estimateUsage(model string, messages []Message, response string) models.Usage {
+	usage := models.Usage{
+		PromptTokens:     CountMessageTokens(model, messages),
+		CompletionTokens: CountTokens(model, response),
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
+}
+
+// validate a request and pick what answers it, the request's quota standing is recorded on it
+func chatBackends(ctx context.Context, request *models.ChatRequest) ([]Provider, db.ChatStore, error) {
+	if err := validateParams(request.GenerationParams); err != nil {
+		return nil, nil, err
+	}
+	providers, err := selectProviders(request.Model)
+	if err != nil {
+		return nil, nil, err
+	}
+	store, err := getStore()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the quota is checked for the user the answer is saved for
+	if request.UserID == "" {
+		if userQuotaEnforced() {
+			return nil, nil, ErrUserRequired
+		}
+		request.UserID = util.GenerateUserID()
+		log.Debug().Msgf("Generated UserID: %s", request.UserID)
+	}
+	if request.Quota, err = checkQuota(ctx, store, request.UserID); err != nil {
+		return nil, nil, err
+	}
+	return providers, store, nil
 }
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+)
+
+var ErrNoUserMessage = errors.New("messages must include a user message")
+
+// prepare a request whose conversation is supplied by the client, the last user turn is what gets saved
+func resolveCompletion(ctx context.Context, request *models.ChatRequest, messages []Message) ([]Provider, db.ChatStore, error) {
+	providers, store, err := chatBackends(ctx, request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request.Message = ""
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			request.Message = messages[i].Content
+			break
+		}
+	}
+	if request.Message == "" {
+		return nil, nil, ErrNoUserMessage
+	}
+
+	if err := resolveConversation(ctx, store, request); err != nil {
+		return nil, nil, err
+	}
+	return providers, store, nil
+}
+
+// answer a conversation supplied by the client as-is, without the stored history or system prompt.
+// The exchange is still saved, in request.ConversationID or a new conversation when it is empty.
+func ProcessCompletion(ctx context.Context, request *models.ChatRequest, messages []Message) (*ChatResult, error) {
+	providers, store, err := resolveCompletion(ctx, request, messages)
+	if err != nil {
+		return nil, err
+	}
+	return completeAnswer(ctx, providers, store, request, messages)
+}
+
+// streaming counterpart of ProcessCompletion, events are the same as those of ProcessStream
+func ProcessCompletionStream(ctx context.Context, request *models.ChatRequest, messages []Message) (<-chan models.StreamEvent, error) {
+	providers, store, err := resolveCompletion(ctx, request, messages)
+	if err != nil {
+		return nil, err
+	}
+	return streamAnswer(ctx, providers, store, request, messages)
+}
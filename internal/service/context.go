@@ -0,0 +1,156 @@
+package service
+
+import (
+	"strings"
+	"sync"
+
+	"go-bot/internal/models"
+
+	"github.com/rs/zerolog/log"
+	"github.com/tiktoken-go/tokenizer"
+)
+
+const (
+	defaultContextWindow = 8192
+
+	// fixed overhead of the chat format, see OpenAI's token counting guide
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+// context window sizes in tokens, matched by model name prefix (longest prefix wins)
+var modelContextWindows = map[string]int{
+	"gpt-3.5-turbo": 16385,
+	"gpt-4":         8192,
+	"gpt-4-turbo":   128000,
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"gpt-5":         400000,
+	"o1":            200000,
+	"o3":            200000,
+	"o4":            200000,
+	"claude":        200000,
+	"llama3":        8192,
+	"llama3.1":      131072,
+	"llama3.2":      131072,
+	"mistral":       32768,
+}
+
+var (
+	// how many stored exchanges are considered before packing them into the budget
+	historyFetchLimit = 50
+	// tokens kept free for the completion
+	completionReserve = 1024
+
+	codecs     = map[tokenizer.Encoding]tokenizer.Codec{}
+	codecMutex sync.Mutex
+)
+
+// set how much history is fetched and how many tokens are kept for the answer
+func ConfigureContextWindow(historyLimit, reserve int) {
+	if historyLimit > 0 {
+		historyFetchLimit = historyLimit
+	}
+	if reserve > 0 {
+		completionReserve = reserve
+	}
+}
+
+// context window of the model, falling back to a conservative default
+func ContextWindow(model string) int {
+	window, matched := defaultContextWindow, ""
+	for prefix, size := range modelContextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > len(matched) {
+			window, matched = size, prefix
+		}
+	}
+	return window
+}
+
+// pick the BPE encoding of the model, non-OpenAI models are approximated with cl100k
+func encodingForModel(model string) tokenizer.Encoding {
+	for _, prefix := range []string{"gpt-5", "gpt-4.1", "gpt-4o", "chatgpt-4o", "o1", "o3", "o4"} {
+		if strings.HasPrefix(model, prefix) {
+			return tokenizer.O200kBase
+		}
+	}
+	return tokenizer.Cl100kBase
+}
+
+func codecForModel(model string) (tokenizer.Codec, error) {
+	encoding := encodingForModel(model)
+
+	codecMutex.Lock()
+	defer codecMutex.Unlock()
+
+	if codec, ok := codecs[encoding]; ok {
+		return codec, nil
+	}
+	codec, err := tokenizer.Get(encoding)
+	if err != nil {
+		return nil, err
+	}
+	codecs[encoding] = codec
+	return codec, nil
+}
+
+// count the tokens of a text for the given model
+func CountTokens(model, text string) int {
+	codec, err := codecForModel(model)
+	if err != nil {
+		// rough estimate when no tokenizer is available
+		log.Warn().Err(err).Str("model", model).Msg("Tokenizer unavailable, estimating token count")
+		return len(text)/4 + 1
+	}
+
+	count, err := codec.Count(text)
+	if err != nil {
+		log.Warn().Err(err).Str("model", model).Msg("Failed to count tokens, estimating token count")
+		return len(text)/4 + 1
+	}
+	return count
+}
+
+// count the tokens of a list of messages including the per-message overhead
+func CountMessageTokens(model string, messages []Message) int {
+	total := 0
+	for _, message := range messages {
+		total += tokensPerMessage + CountTokens(model, message.Role) + CountTokens(model, message.Content)
+	}
+	return total
+}
+
+// construct the conversation with as many recent exchanges as fit in the model's budget, leaving room for
+// an answer of params.MaxTokens and at least the configured reserve
+func BuildContext(model, userMessage string, history []models.ChatMessage, systemMessage string, params models.GenerationParams) []Message {
+	reserve := completionReserve
+	if params.MaxTokens != nil {
+		reserve = max(reserve, *params.MaxTokens)
+	}
+	base := BuildMessages(userMessage, nil, systemMessage)
+	budget := ContextWindow(model) - reserve - tokensPerReply - CountMessageTokens(model, base)
+
+	// walk from the newest exchange backwards and stop at the first one that does not fit
+	start := len(history)
+	for i := len(history) - 1; i >= 0; i-- {
+		cost := CountMessageTokens(model, exchangeMessages(history[i]))
+		if cost > budget {
+			break
+		}
+		budget -= cost
+		start = i
+	}
+
+	if budget < 0 {
+		log.Warn().Str("model", model).Int("over_budget", -budget).Msg("Message alone exceeds the context budget")
+	}
+
+	log.Debug().
+		Str("model", model).
+		Int("history_available", len(history)).
+		Int("history_used", len(history)-start).
+		Int("tokens_left", budget).
+		Msg("Context window packed")
+
+	return BuildMessages(userMessage, history[start:], systemMessage)
+}
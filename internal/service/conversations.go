@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+	"go-bot/internal/util"
+)
+
+var ErrNoStore = errors.New("no chat store configured")
+
+var (
+	activeStore db.ChatStore
+	storeMutex  sync.RWMutex
+)
+
+// replace the store used to persist chats and conversations
+func SetStore(store db.ChatStore) {
+	storeMutex.Lock()
+	defer storeMutex.Unlock()
+	activeStore = store
+}
+
+func getStore() (db.ChatStore, error) {
+	storeMutex.RLock()
+	defer storeMutex.RUnlock()
+	if activeStore == nil {
+		return nil, ErrNoStore
+	}
+	return activeStore, nil
+}
+
+// load a conversation, conversations of other users or started with other API keys are reported as missing
+func GetConversation(ctx context.Context, userID, conversationID string) (*models.Conversation, error) {
+	store, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+
+	conversation, err := store.GetConversation(ctx, conversationID)
+	if err != nil {
+		return nil, err
+	}
+	if conversation.UserID != userID || !keyMayAccess(ctx, conversation.APIKeyID) {
+		return nil, db.ErrConversationNotFound
+	}
+	return conversation, nil
+}
+
+// list the conversations of the user started with the API key of the request
+func ListConversations(ctx context.Context, userID string, includeArchived bool) ([]models.Conversation, error) {
+	store, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	conversations, err := store.ListConversations(ctx, userID, includeArchived)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(conversations, func(conversation models.Conversation) bool {
+		return !keyMayAccess(ctx, conversation.APIKeyID)
+	}), nil
+}
+
+// whether the API key of the request may access what was made with ownerKeyID. User IDs are chosen by the
+// client, so they only separate the users of one key; what was made without a key, such as conversations
+// from before keys were recorded, is open to every key.
+func keyMayAccess(ctx context.Context, ownerKeyID string) bool {
+	return ownerKeyID == "" || ownerKeyID == util.APIKeyID(ctx)
+}
+
+// return a conversation owned by the user with its newest messages, oldest first
+func GetConversationMessages(ctx context.Context, userID, conversationID string, limit int) (*models.Conversation, []models.ChatMessage, error) {
+	conversation, err := GetConversation(ctx, userID, conversationID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	store, err := getStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	messages, err := store.GetChatHistory(ctx, conversationID, limit)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conversation, messages, nil
+}
+
+func UpdateConversation(ctx context.Context, userID, conversationID string, update models.ConversationUpdate) (*models.Conversation, error) {
+	if _, err := GetConversation(ctx, userID, conversationID); err != nil {
+		return nil, err
+	}
+
+	store, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.UpdateConversation(ctx, conversationID, update)
+}
+
+func DeleteConversation(ctx context.Context, userID, conversationID string) error {
+	if _, err := GetConversation(ctx, userID, conversationID); err != nil {
+		return err
+	}
+
+	store, err := getStore()
+	if err != nil {
+		return err
+	}
+	return store.DeleteConversation(ctx, conversationID)
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrorKind classifies why a call to an LLM backend failed
+type ErrorKind string
+
+const (
+	ErrorRateLimited    ErrorKind = "rate_limited"            // 429, retried
+	ErrorServer         ErrorKind = "server_error"            // 5xx or overloaded, retried
+	ErrorTimeout        ErrorKind = "timeout"                 // no answer in time, retried
+	ErrorUnavailable    ErrorKind = "unavailable"             // backend unreachable, retried
+	ErrorQuotaExceeded  ErrorKind = "quota_exceeded"          // the account ran out of credit
+	ErrorContextLength  ErrorKind = "context_length_exceeded" // the conversation does not fit the model
+	ErrorAuth           ErrorKind = "auth"                    // missing, invalid or unauthorized API key
+	ErrorInvalidRequest ErrorKind = "invalid_request"         // any other rejected request
+)
+
+// ProviderError is a failed call to an LLM backend
+type ProviderError struct {
+	Provider   string
+	Kind       ErrorKind
+	StatusCode int           // HTTP status, zero when no response was received
+	Type       string        // error type reported by the backend, e.g. rate_limit_error
+	Code       string        // error code reported by the backend, e.g. context_length_exceeded
+	Message    string        // error text reported by the backend
+	RetryAfter time.Duration // delay asked for by the backend, zero when none
+	Err        error         // underlying transport error
+}
+
+func (e *ProviderError) Error() string {
+	switch {
+	case e.StatusCode != 0:
+		return fmt.Sprintf("%s: %s (status %d): %s", e.Provider, e.Kind, e.StatusCode, e.Message)
+	case e.Err != nil:
+		return fmt.Sprintf("%s: %s: %v", e.Provider, e.Kind, e.Err)
+	default:
+		return fmt.Sprintf("%s: %s: %s", e.Provider, e.Kind, e.Message)
+	}
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// whether trying the same request again may succeed
+func (e *ProviderError) Retryable() bool {
+	switch e.Kind {
+	case ErrorRateLimited, ErrorServer, ErrorTimeout, ErrorUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// status reported to our clients, problems with our own account or the backend are not the client's fault
+func (e *ProviderError) HTTPStatus() int {
+	switch e.Kind {
+	case ErrorRateLimited:
+		return http.StatusTooManyRequests
+	case ErrorContextLength, ErrorInvalidRequest:
+		return http.StatusBadRequest
+	case ErrorTimeout:
+		return http.StatusGatewayTimeout
+	case ErrorQuotaExceeded:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// code reported to our clients, see util.HTTPError
+func (e *ProviderError) ErrorCode() string {
+	switch e.Kind {
+	case ErrorAuth:
+		return "upstream_auth_failed"
+	case ErrorQuotaExceeded:
+		return "upstream_quota_exceeded"
+	case ErrorServer, ErrorUnavailable:
+		return "upstream_unavailable"
+	case ErrorTimeout:
+		return "upstream_timeout"
+	default:
+		return string(e.Kind)
+	}
+}
+
+const maxErrorBodySize = 64 * 1024
+
+func classifyTransportError(provider string, err error) *ProviderError {
+	kind := ErrorUnavailable
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = ErrorTimeout
+	}
+	return &ProviderError{Provider: provider, Kind: kind, Err: err}
+}
+
+// read and close an error response
+func classifyResponse(provider string, resp *http.Response) *ProviderError {
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	providerErr := parseErrorBody(body)
+	providerErr.Provider = provider
+	providerErr.StatusCode = resp.StatusCode
+	providerErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		providerErr.Kind = ErrorAuth
+	case providerErr.Code == "insufficient_quota":
+		// OpenAI reports an exhausted account as a 429, waiting does not help
+		providerErr.Kind = ErrorQuotaExceeded
+	case resp.StatusCode == http.StatusTooManyRequests:
+		providerErr.Kind = ErrorRateLimited
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusGatewayTimeout:
+		providerErr.Kind = ErrorTimeout
+	case resp.StatusCode >= http.StatusInternalServerError:
+		providerErr.Kind = ErrorServer
+	case resp.StatusCode == http.StatusRequestEntityTooLarge || providerErr.Code == "context_length_exceeded" || isContextLengthMessage(providerErr.Message):
+		providerErr.Kind = ErrorContextLength
+	default:
+		providerErr.Kind = ErrorInvalidRequest
+	}
+	return providerErr
+}
+
+// parse the error bodies of OpenAI ({"error": {"message", "type", "code"}}), Anthropic
+// ({"type": "error", "error": {"type", "message"}}) and Ollama ({"error": "..."}), falling back to the raw text
+func parseErrorBody(body []byte) *ProviderError {
+	var structured struct {
+		Error struct {
+			Message string          `json:"message"`
+			Type    string          `json:"type"`
+			Code    json.RawMessage `json:"code"` // a string, a number or null depending on the backend
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &structured); err == nil && structured.Error.Message != "" {
+		var code string
+		if json.Unmarshal(structured.Error.Code, &code) != nil {
+			code = strings.Trim(string(structured.Error.Code), `"`)
+			if code == "null" {
+				code = ""
+			}
+		}
+		return &ProviderError{Message: structured.Error.Message, Type: structured.Error.Type, Code: code}
+	}
+
+	var plain struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &plain); err == nil && plain.Error != "" {
+		return &ProviderError{Message: plain.Error}
+	}
+
+	return &ProviderError{Message: strings.TrimSpace(string(body))}
+}
+
+// error reported in the middle of a stream, where no HTTP status is available
+func streamError(provider, errorType, message string) *ProviderError {
+	kind := ErrorServer
+	switch {
+	case errorType == "rate_limit_error":
+		kind = ErrorRateLimited
+	case isContextLengthMessage(message):
+		kind = ErrorContextLength
+	case errorType == "invalid_request_error":
+		kind = ErrorInvalidRequest
+	}
+	return &ProviderError{Provider: provider, Kind: kind, Type: errorType, Message: message}
+}
+
+// wording used by OpenAI, Anthropic and Ollama when a conversation does not fit the model
+func isContextLengthMessage(message string) bool {
+	message = strings.ToLower(message)
+	for _, marker := range []string{"context_length_exceeded", "maximum context length", "prompt is too long", "context window"} {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"go-bot/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// whether the next provider of the chain may answer where this one failed. Outages, rate limits and problems
+// with our account at the backend are worth another try elsewhere, a request the backend rejected is not.
+func shouldFallBack(err error) bool {
+	var providerErr *ProviderError
+	if !errors.As(err, &providerErr) {
+		return false
+	}
+	return providerErr.Retryable() || providerErr.Kind == ErrorAuth || providerErr.Kind == ErrorQuotaExceeded
+}
+
+// ask the providers in order until one answers, returning the provider that did
+func completeWithFallback(ctx context.Context, providers []Provider, messages []Message, params models.GenerationParams) (Provider, *Completion, error) {
+	var err error
+	for i, provider := range providers {
+		var completion *Completion
+		completion, err = provider.Complete(ctx, messages, params)
+		if err == nil {
+			return provider, completion, nil
+		}
+		if !fallBack(ctx, providers, i, err) {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+// start streaming from the providers in order until one accepts, returning the provider that did. Once a
+// stream has started it is not switched, so nothing a client has already received is answered twice.
+func streamWithFallback(ctx context.Context, providers []Provider, messages []Message, params models.GenerationParams) (Provider, <-chan StreamChunk, error) {
+	var err error
+	for i, provider := range providers {
+		var chunks <-chan StreamChunk
+		chunks, err = provider.Stream(ctx, messages, params)
+		if err == nil {
+			return provider, chunks, nil
+		}
+		if !fallBack(ctx, providers, i, err) {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+// whether to move on after providers[failed] returned err, logging the switch
+func fallBack(ctx context.Context, providers []Provider, failed int, err error) bool {
+	if ctx.Err() != nil || failed == len(providers)-1 || !shouldFallBack(err) {
+		return false
+	}
+	log.Warn().
+		Err(err).
+		Str("provider", providers[failed].Name()).
+		Str("fallback", providers[failed+1].Name()).
+		Str("fallback_model", providers[failed+1].Model()).
+		Msg("LLM provider failed, falling back")
+	return true
+}
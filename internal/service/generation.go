@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"go-bot/internal/models"
+)
+
+var ErrInvalidParameters = errors.New("invalid generation parameters")
+
+// upper bound on the max_tokens a client may ask for
+var maxOutputTokens = 4096
+
+// set the upper bound on max_tokens
+func ConfigureGeneration(maxTokens int) {
+	if maxTokens > 0 {
+		maxOutputTokens = maxTokens
+	}
+}
+
+// check the parameters of a request against the ranges every provider accepts
+func validateParams(params models.GenerationParams) error {
+	if params.Temperature != nil && (*params.Temperature < 0 || *params.Temperature > 2) {
+		return fmt.Errorf("%w: temperature must be between 0 and 2", ErrInvalidParameters)
+	}
+	if params.TopP != nil && (*params.TopP < 0 || *params.TopP > 1) {
+		return fmt.Errorf("%w: top_p must be between 0 and 1", ErrInvalidParameters)
+	}
+	if params.MaxTokens != nil && (*params.MaxTokens < 1 || *params.MaxTokens > maxOutputTokens) {
+		return fmt.Errorf("%w: max_tokens must be between 1 and %d", ErrInvalidParameters, maxOutputTokens)
+	}
+	if len(params.Stop) > 4 {
+		return fmt.Errorf("%w: at most 4 stop sequences are allowed", ErrInvalidParameters)
+	}
+	if slices.Contains(params.Stop, "") {
+		return fmt.Errorf("%w: stop sequences cannot be empty", ErrInvalidParameters)
+	}
+	return nil
+}
+
+// whether clients may ask for model by name
+func AllowedModel(model string) bool {
+	providerMutex.RLock()
+	defer providerMutex.RUnlock()
+	_, ok := allowedModels[model]
+	return ok
+}
+
+// providers to try for a request, a requested model is tried first and the fallback chain after it
+func selectProviders(model string) ([]Provider, error) {
+	providers, err := getProviders()
+	if err != nil || model == "" {
+		return providers, err
+	}
+
+	providerMutex.RLock()
+	requested, ok := allowedModels[model]
+	providerMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: model %q is not allowed", ErrInvalidParameters, model)
+	}
+
+	selected := []Provider{requested}
+	for _, provider := range providers {
+		if provider != requested {
+			selected = append(selected, provider)
+		}
+	}
+	return selected, nil
+}
+
+// parameters saved with a message, nil when the provider's defaults were used
+func storedParams(params models.GenerationParams) *models.GenerationParams {
+	if params.IsZero() {
+		return nil
+	}
+	return &params
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrInvalidAPIKeyRequest = errors.New("invalid API key request")
+	// the key is unknown, expired or revoked, which clients are not told apart
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+const (
+	apiKeyPrefix = "gb_"
+	// characters of a key kept to recognize it by in listings
+	apiKeyVisibleLength = 11
+)
+
+var apiKeyScopes = []string{models.APIKeyScopeChat, models.APIKeyScopeStream, models.APIKeyScopeAdmin}
+
+// hex encoded SHA-256 of a key, what is stored and looked up instead of the key.
+// Keys are long random strings, so a fast unsalted hash is enough to keep them from being recovered.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// create a managed key, returning it with the key itself, which is not stored and cannot be shown again
+func CreateAPIKey(ctx context.Context, request models.APIKeyRequest) (*models.APIKey, string, error) {
+	name := strings.TrimSpace(request.Name)
+	if name == "" || len(name) > 100 {
+		return nil, "", fmt.Errorf("%w: name must be between 1 and 100 characters", ErrInvalidAPIKeyRequest)
+	}
+	if len(request.Scopes) == 0 {
+		return nil, "", fmt.Errorf("%w: at least one scope is required", ErrInvalidAPIKeyRequest)
+	}
+	var scopes []string
+	for _, scope := range request.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return nil, "", fmt.Errorf("%w: unknown scope %q, expected chat, stream or admin", ErrInvalidAPIKeyRequest, scope)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	now := time.Now().UTC()
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(now) {
+		return nil, "", fmt.Errorf("%w: expires_at must be in the future", ErrInvalidAPIKeyRequest)
+	}
+
+	store, err := getStore()
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	plaintext := apiKeyPrefix + hex.EncodeToString(secret)
+
+	key := models.APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		Prefix:    plaintext[:apiKeyVisibleLength],
+		Hash:      HashAPIKey(plaintext),
+		Scopes:    scopes,
+		CreatedAt: now,
+	}
+	if request.ExpiresAt != nil {
+		expiresAt := request.ExpiresAt.UTC()
+		key.ExpiresAt = &expiresAt
+	}
+	if err := store.CreateAPIKey(ctx, key); err != nil {
+		return nil, "", err
+	}
+
+	log.Info().
+		Str("keyID", key.ID.Hex()).
+		Str("name", key.Name).
+		Strs("scopes", key.Scopes).
+		Msg("API key created")
+	return &key, plaintext, nil
+}
+
+func ListAPIKeys(ctx context.Context) ([]models.APIKey, error) {
+	store, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.ListAPIKeys(ctx)
+}
+
+// revoke a managed key, it stops working at once
+func RevokeAPIKey(ctx context.Context, keyID string) (*models.APIKey, error) {
+	store, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.RevokeAPIKey(ctx, keyID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("keyID", keyID).Msg("API key revoked")
+	return key, nil
+}
+
+// find the managed key a client sent, ErrUnauthorized when it is unknown, expired or revoked
+func AuthenticateAPIKey(ctx context.Context, presented string) (*models.APIKey, error) {
+	if !strings.HasPrefix(presented, apiKeyPrefix) {
+		return nil, ErrUnauthorized
+	}
+	store, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := HashAPIKey(presented)
+	key, err := store.GetAPIKeyByHash(ctx, hash)
+	if errors.Is(err, db.ErrAPIKeyNotFound) {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the lookup matched already, comparing in constant time keeps it that way should the store match loosely
+	if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) != 1 {
+		return nil, ErrUnauthorized
+	}
+	if !key.Active(time.Now()) {
+		log.Warn().Str("keyID", key.ID.Hex()).Msg("Expired or revoked API key used")
+		return nil, ErrUnauthorized
+	}
+	return key, nil
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go-bot/internal/models"
+	"go-bot/internal/util"
+
+	"github.com/rs/zerolog/log"
+)
+
+// structure of the Ollama /api/chat request payload
+type OllamaRequestPayload struct {
+	Model    string         `json:"model"`             // local model to use, e.g. llama3.1
+	Messages []Message      `json:"messages"`          // including user and system roles
+	Stream   bool           `json:"stream"`            // Ollama streams by default, so always sent
+	Options  *OllamaOptions `json:"options,omitempty"` // sampling parameters, the model's defaults when unset
+}
+
+// sampling parameters of an Ollama request, named after the Modelfile parameters
+type OllamaOptions struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	NumPredict  *int     `json:"num_predict,omitempty"` // maximum number of tokens to generate
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int64   `json:"seed,omitempty"`
+}
+
+// structure of a response line from the Ollama /api/chat endpoint
+type OllamaResponseBody struct {
+	Message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	} `json:"message"`
+	Done       bool   `json:"done"`        // true on the last line of a stream
+	DoneReason string `json:"done_reason"` // why the answer ended, e.g. stop or length
+	Error      string `json:"error"`       // set when the model fails mid-stream
+
+	// token counts, set on the last line
+	PromptEvalCount int `json:"prompt_eval_count"`
+	EvalCount       int `json:"eval_count"`
+}
+
+// why an Ollama answer ended, older servers do not say
+func ollamaFinishReason(doneReason string) string {
+	if doneReason == "" {
+		return "stop"
+	}
+	return doneReason
+}
+
+// provider for Ollama and other servers exposing an Ollama-compatible /api/chat
+type OllamaProvider struct {
+	baseURL string
+	model   string
+}
+
+func NewOllamaProvider(baseURL, model string) *OllamaProvider {
+	return &OllamaProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		model:   model,
+	}
+}
+
+func (p *OllamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *OllamaProvider) Model() string {
+	return p.model
+}
+
+func (p *OllamaProvider) buildPayload(messages []Message, params models.GenerationParams, stream bool) OllamaRequestPayload {
+	payload := OllamaRequestPayload{
+		Model:    p.model,
+		Messages: messages,
+		Stream:   stream,
+	}
+	if !params.IsZero() {
+		payload.Options = &OllamaOptions{
+			Temperature: params.Temperature,
+			TopP:        params.TopP,
+			NumPredict:  params.MaxTokens,
+			Stop:        params.Stop,
+			Seed:        params.Seed,
+		}
+	}
+
+	log.Debug().Interface("payload", payload).Msg("Constructed Ollama payload")
+	return payload
+}
+
+// send request to the local model and return the response
+func (p *OllamaProvider) Complete(ctx context.Context, messages []Message, params models.GenerationParams) (*Completion, error) {
+	payload := p.buildPayload(messages, params, false)
+
+	log.Debug().Msg("Sending request to Ollama")
+	resp, err := sendWithRetry(ctx, p.Name(), func() (*http.Response, error) {
+		return util.SendJSONRequest(ctx, p.baseURL+"/api/chat", nil, payload, false)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to call Ollama")
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	log.Debug().Int("status_code", resp.StatusCode).Msg("Received response from Ollama")
+
+	var responseBody OllamaResponseBody
+	if err := json.NewDecoder(resp.Body).Decode(&responseBody); err != nil {
+		log.Error().Err(err).Msg("Failed to decode Ollama response")
+		return nil, err
+	}
+
+	if responseBody.Error != "" {
+		log.Error().Str("error_message", responseBody.Error).Msg("Ollama returned an error")
+		return nil, streamError(p.Name(), "", responseBody.Error)
+	}
+
+	if responseBody.Message.Content != "" {
+		log.Debug().Str("response_content", responseBody.Message.Content).Msg("Ollama response content")
+		return &Completion{
+			Text:         responseBody.Message.Content,
+			FinishReason: ollamaFinishReason(responseBody.DoneReason),
+			Usage:        reportedUsage(responseBody.PromptEvalCount, responseBody.EvalCount),
+		}, nil
+	}
+
+	log.Error().Msg("No response content from Ollama")
+	return nil, errors.New("no response content from Ollama")
+}
+
+// stream the newline-delimited JSON response of the local model as content chunks
+func (p *OllamaProvider) Stream(ctx context.Context, messages []Message, params models.GenerationParams) (<-chan StreamChunk, error) {
+	payload := p.buildPayload(messages, params, true)
+
+	resp, err := sendWithRetry(ctx, p.Name(), func() (*http.Response, error) {
+		return util.SendJSONRequest(ctx, p.baseURL+"/api/chat", nil, payload, true)
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send streaming request to Ollama")
+		return nil, err
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer func() {
+			resp.Body.Close()
+			close(chunks)
+		}()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+
+			var streamBody OllamaResponseBody
+			if err := json.Unmarshal([]byte(line), &streamBody); err != nil {
+				log.Error().Err(err).Str("data", line).Msg("Failed to decode stream data")
+				continue
+			}
+
+			if streamBody.Error != "" {
+				log.Error().Str("error_message", streamBody.Error).Msg("Ollama stream returned an error")
+				sendChunk(ctx, chunks, StreamChunk{Err: streamError(p.Name(), "", streamBody.Error)})
+				return
+			}
+
+			if streamBody.Message.Content != "" {
+				if !sendChunk(ctx, chunks, StreamChunk{Text: streamBody.Message.Content}) {
+					return
+				}
+			}
+
+			if streamBody.Done {
+				log.Debug().Msg("Stream completed")
+				if !sendChunk(ctx, chunks, StreamChunk{Usage: reportedUsage(streamBody.PromptEvalCount, streamBody.EvalCount)}) {
+					return
+				}
+				sendChunk(ctx, chunks, StreamChunk{FinishReason: ollamaFinishReason(streamBody.DoneReason)})
+				return
+			}
+		}
+
+		if ctx.Err() != nil {
+			log.Debug().Msg("Stream cancelled by the client")
+			return
+		}
+		if err := scanner.Err(); err != nil {
+			log.Error().Err(err).Msg("Error reading streamed data")
+			sendChunk(ctx, chunks, StreamChunk{Err: err})
+		}
+	}()
+
+	return chunks, nil
+}
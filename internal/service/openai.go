@@ -1,23 +1,42 @@
 package service
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
-	"os"
-	"time"
+	"strings"
+	"sync/atomic"
 
 	"go-bot/internal/models"
+	"go-bot/internal/util"
 
 	"github.com/rs/zerolog/log"
 )
 
 // structure of the request payload
 type ChatGPTRequestPayload struct {
-	Messages []map[string]string `json:"messages"`         // including user and system roles
-	Model    string              `json:"model"`            // OpenAI model to use
-	Stream   bool                `json:"stream,omitempty"` // flag for streaming responses
+	Messages    []Message `json:"messages"`              // including user and system roles
+	Model       string    `json:"model"`                 // OpenAI model to use
+	Stream      bool      `json:"stream,omitempty"`      // flag for streaming responses
+	Temperature *float64  `json:"temperature,omitempty"` // sampling parameters, the API defaults when unset
+	TopP        *float64  `json:"top_p,omitempty"`
+	MaxTokens   *int      `json:"max_tokens,omitempty"`
+	Stop        []string  `json:"stop,omitempty"`
+	Seed        *int64    `json:"seed,omitempty"`
+
+	StreamOptions *ChatGPTStreamOptions `json:"stream_options,omitempty"` // streaming only
+}
+
+type ChatGPTStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // ask for a last chunk carrying the token usage
+}
+
+// token counts of an OpenAI answer
+type ChatGPTUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
 }
 
 // structure of response body from the OpenAI API
@@ -27,61 +46,87 @@ type ChatGPTResponseBody struct {
 			Role    string `json:"role"`    // role of the message (e.g., assistant)
 			Content string `json:"content"` // content of the response
 		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage *ChatGPTUsage `json:"usage"`
 }
 
-// construct payload for OpenAI API
-func BuildChatGPTPayload(userMessage string, history []models.ChatMessage, systemMessage string) ChatGPTRequestPayload {
-	log.Debug().Str("userMessage", userMessage).Msg("Building payload")
-	log.Debug().Int("history_length", len(history)).Msg("Chat history length")
-	log.Debug().Str("systemMessage", systemMessage).Msg("System message used")
+// structure of a streamed chunk from the OpenAI API
+type ChatGPTStreamBody struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"` // set on the last chunk of a choice
+	} `json:"choices"`
+	Usage *ChatGPTUsage `json:"usage"` // set on the extra last chunk requested with include_usage
+	Error *struct {
+		Message string `json:"message"`
+		Type    string `json:"type"`
+	} `json:"error"` // sent instead of choices when the model fails mid-stream
+}
 
-	messages := []map[string]string{
-		{"role": "system", "content": systemMessage},
-	}
+// provider for the OpenAI chat completions API and compatible servers
+type OpenAIProvider struct {
+	baseURL string
+	apiKey  string
+	model   string
 
-	// add chat history to the messages
-	for _, chat := range history {
-		messages = append(messages, map[string]string{"role": "user", "content": chat.Message})
+	// the server rejected stream_options, streams are requested without it and their usage is estimated
+	streamUsageUnsupported atomic.Bool
+}
+
+func NewOpenAIProvider(baseURL, apiKey, model string) *OpenAIProvider {
+	return &OpenAIProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		model:   model,
 	}
-	messages = append(messages, map[string]string{"role": "user", "content": userMessage})
+}
+
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
+
+func (p *OpenAIProvider) Model() string {
+	return p.model
+}
 
+// construct payload for OpenAI API
+func (p *OpenAIProvider) buildPayload(messages []Message, params models.GenerationParams, stream bool) ChatGPTRequestPayload {
 	payload := ChatGPTRequestPayload{
-		Messages: messages,
-		Model:    "gpt-4-turbo",
+		Messages:    messages,
+		Model:       p.model,
+		Stream:      stream,
+		Temperature: params.Temperature,
+		TopP:        params.TopP,
+		MaxTokens:   params.MaxTokens,
+		Stop:        params.Stop,
+		Seed:        params.Seed,
+	}
+	if stream && !p.streamUsageUnsupported.Load() {
+		payload.StreamOptions = &ChatGPTStreamOptions{IncludeUsage: true}
 	}
 
 	log.Debug().Interface("payload", payload).Msg("Constructed OpenAI payload")
 	return payload
 }
 
-// send request to OpenAI's API and return the response
-func CallOpenAI(payload ChatGPTRequestPayload) (string, error) {
-	// convert the payload into JSON
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to marshal payload")
-		return "", err
-	}
-	log.Debug().Str("json_payload", string(jsonData)).Msg("Marshalled payload for OpenAI")
+func (p *OpenAIProvider) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + p.apiKey}
+}
 
-	// create HTTP request
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to create OpenAI API request")
-		return "", err
-	}
+// send request to OpenAI's API and return the response
+func (p *OpenAIProvider) Complete(ctx context.Context, messages []Message, params models.GenerationParams) (*Completion, error) {
+	payload := p.buildPayload(messages, params, false)
 
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENAI_API_KEY"))
-	req.Header.Set("Content-Type", "application/json")
 	log.Debug().Msg("Sending request to OpenAI API")
-
-	// send the request using an HTTP client
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	resp, err := sendWithRetry(ctx, p.Name(), func() (*http.Response, error) {
+		return util.SendJSONRequest(ctx, p.baseURL+"/chat/completions", p.headers(), payload, false)
+	})
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to call OpenAI API")
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -91,14 +136,116 @@ func CallOpenAI(payload ChatGPTRequestPayload) (string, error) {
 	var responseBody ChatGPTResponseBody
 	if err := json.NewDecoder(resp.Body).Decode(&responseBody); err != nil {
 		log.Error().Err(err).Msg("Failed to decode OpenAI API response")
-		return "", err
+		return nil, err
 	}
 
 	if len(responseBody.Choices) > 0 {
-		log.Debug().Str("response_content", responseBody.Choices[0].Message.Content).Msg("OpenAI response content")
-		return responseBody.Choices[0].Message.Content, nil
+		choice := responseBody.Choices[0]
+		log.Debug().Str("response_content", choice.Message.Content).Msg("OpenAI response content")
+		completion := &Completion{Text: choice.Message.Content, FinishReason: choice.FinishReason}
+		if responseBody.Usage != nil {
+			completion.Usage = reportedUsage(responseBody.Usage.PromptTokens, responseBody.Usage.CompletionTokens)
+		}
+		return completion, nil
 	}
 
 	log.Error().Msg("No response content from OpenAI API")
-	return "", errors.New("no response content from OpenAI API")
+	return nil, errors.New("no response content from OpenAI API")
+}
+
+func (p *OpenAIProvider) sendStream(ctx context.Context, payload ChatGPTRequestPayload) (*http.Response, error) {
+	return sendWithRetry(ctx, p.Name(), func() (*http.Response, error) {
+		return util.SendJSONRequest(ctx, p.baseURL+"/chat/completions", p.headers(), payload, true)
+	})
+}
+
+// stream the response of OpenAI's API as content chunks
+func (p *OpenAIProvider) Stream(ctx context.Context, messages []Message, params models.GenerationParams) (<-chan StreamChunk, error) {
+	payload := p.buildPayload(messages, params, true)
+
+	resp, err := p.sendStream(ctx, payload)
+	// some compatible servers, such as older vLLM and LocalAI, reject fields they do not know
+	var providerErr *ProviderError
+	if payload.StreamOptions != nil && errors.As(err, &providerErr) && providerErr.Kind == ErrorInvalidRequest {
+		payload.StreamOptions = nil
+		resp, err = p.sendStream(ctx, payload)
+		if err == nil {
+			log.Warn().Str("base_url", p.baseURL).Msg("Server rejected stream_options, streaming without usage reports")
+			p.streamUsageUnsupported.Store(true)
+		}
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to send streaming request to OpenAI")
+		return nil, err
+	}
+
+	chunks := make(chan StreamChunk)
+	go func() {
+		defer func() {
+			resp.Body.Close()
+			close(chunks)
+		}()
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+
+			// remove "data: " prefix and trim spaces
+			data := strings.TrimSpace(line[6:])
+
+			// check for stream end
+			if data == "[DONE]" {
+				log.Debug().Msg("Stream completed")
+				break
+			}
+
+			var streamBody ChatGPTStreamBody
+			if err := json.Unmarshal([]byte(data), &streamBody); err != nil {
+				log.Error().Err(err).Str("data", data).Msg("Failed to decode stream data")
+				continue
+			}
+
+			if streamBody.Error != nil {
+				log.Error().Str("error_message", streamBody.Error.Message).Msg("OpenAI stream returned an error")
+				sendChunk(ctx, chunks, StreamChunk{Err: streamError(p.Name(), streamBody.Error.Type, streamBody.Error.Message)})
+				return
+			}
+
+			if streamBody.Usage != nil {
+				usage := reportedUsage(streamBody.Usage.PromptTokens, streamBody.Usage.CompletionTokens)
+				if !sendChunk(ctx, chunks, StreamChunk{Usage: usage}) {
+					return
+				}
+			}
+
+			// process content chunks
+			for _, choice := range streamBody.Choices {
+				if content := choice.Delta.Content; content != "" {
+					if !sendChunk(ctx, chunks, StreamChunk{Text: content}) {
+						return
+					}
+				}
+				if choice.FinishReason != "" {
+					if !sendChunk(ctx, chunks, StreamChunk{FinishReason: choice.FinishReason}) {
+						return
+					}
+				}
+			}
+		}
+
+		if ctx.Err() != nil {
+			log.Debug().Msg("Stream cancelled by the client")
+			return
+		}
+		if err := scanner.Err(); err != nil {
+			log.Error().Err(err).Msg("Error reading streamed data")
+			sendChunk(ctx, chunks, StreamChunk{Err: err})
+		}
+	}()
+
+	return chunks, nil
 }
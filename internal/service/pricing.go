@@ -0,0 +1,64 @@
+package service
+
+import (
+	"strings"
+	"sync"
+
+	"go-bot/internal/models"
+)
+
+// list prices in USD per million tokens, keyed by model or by the prefix of dated model versions
+var (
+	pricingMutex sync.RWMutex
+	modelPrices  = map[string]models.ModelPrice{
+		"gpt-4o":        {Input: 2.5, Output: 10},
+		"gpt-4o-mini":   {Input: 0.15, Output: 0.6},
+		"gpt-4-turbo":   {Input: 10, Output: 30},
+		"gpt-4.1":       {Input: 2, Output: 8},
+		"gpt-4.1-mini":  {Input: 0.4, Output: 1.6},
+		"gpt-3.5-turbo": {Input: 0.5, Output: 1.5},
+
+		"claude-3-5-sonnet": {Input: 3, Output: 15},
+		"claude-3-5-haiku":  {Input: 0.8, Output: 4},
+		"claude-3-opus":     {Input: 15, Output: 75},
+		"claude-3-haiku":    {Input: 0.25, Output: 1.25},
+	}
+)
+
+// add or override model prices, a model priced at zero is free
+func ConfigurePricing(prices map[string]models.ModelPrice) {
+	pricingMutex.Lock()
+	defer pricingMutex.Unlock()
+	for model, price := range prices {
+		modelPrices[model] = price
+	}
+}
+
+// price of a model, falling back to the longest priced prefix so "gpt-4o-2024-08-06" is billed as "gpt-4o"
+func modelPrice(model string) (models.ModelPrice, bool) {
+	pricingMutex.RLock()
+	defer pricingMutex.RUnlock()
+
+	if price, ok := modelPrices[model]; ok {
+		return price, true
+	}
+	var (
+		best  models.ModelPrice
+		match string
+	)
+	for prefix, price := range modelPrices {
+		if len(prefix) > len(match) && strings.HasPrefix(model, prefix+"-") {
+			best, match = price, prefix
+		}
+	}
+	return best, match != ""
+}
+
+// cost of an exchange in USD, zero for models without a price such as local ones
+func exchangeCost(model string, usage models.Usage) float64 {
+	price, ok := modelPrice(model)
+	if !ok {
+		return 0
+	}
+	return (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1_000_000
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"go-bot/internal/config"
+	"go-bot/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// single chat turn sent to an LLM backend
+type Message struct {
+	Role    string `json:"role"`    // system, user or assistant
+	Content string `json:"content"` // text of the turn
+}
+
+// full answer of a backend
+type Completion struct {
+	Text         string
+	FinishReason string        // stop or length, in OpenAI terms
+	Usage        *models.Usage // token counts reported by the backend, nil when it reports none
+}
+
+// piece of a streamed answer, a chunk carries either text, the reason the answer ended, the token counts
+// reported by the backend or the error that ended it
+type StreamChunk struct {
+	Text         string
+	FinishReason string // stop or length, in OpenAI terms
+	Usage        *models.Usage
+	Err          error
+}
+
+// token counts reported by a backend
+func reportedUsage(promptTokens, completionTokens int) *models.Usage {
+	return &models.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// Provider is an LLM backend able to answer a conversation
+type Provider interface {
+	// name of the backend, e.g. "openai"
+	Name() string
+	// model used for completions
+	Model() string
+	// return the full answer for the conversation, the request is aborted when the context ends
+	Complete(ctx context.Context, messages []Message, params models.GenerationParams) (*Completion, error)
+	// stream the answer as chunks, the channel is closed when the answer ends
+	// or the context is cancelled, in which case the upstream request is aborted
+	Stream(ctx context.Context, messages []Message, params models.GenerationParams) (<-chan StreamChunk, error)
+}
+
+var ErrNoProvider = errors.New("no LLM provider configured")
+
+// implemented by providers that always send a max_tokens, reporting the one sent when a request sets none
+type maxTokensDefaulter interface {
+	DefaultMaxTokens() int
+}
+
+var (
+	// fallback chain, the first provider serves every answer it can
+	activeProviders []Provider
+	// providers of the models clients may ask for by name, those of the fallback chain included
+	allowedModels map[string]Provider
+	providerMutex sync.RWMutex
+)
+
+// deliver a chunk unless the consumer has gone away, reports whether streaming should continue
+func sendChunk(ctx context.Context, chunks chan<- StreamChunk, chunk StreamChunk) bool {
+	select {
+	case chunks <- chunk:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// build the fallback chain selected in the config
+func NewProviders(cfg *config.Config) ([]Provider, error) {
+	providers := make([]Provider, 0, len(cfg.LLMProviders))
+	for _, entry := range cfg.LLMProviders {
+		name, model, _ := strings.Cut(entry, ":")
+		provider, err := NewProvider(cfg, name, model)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, provider)
+	}
+	if len(providers) == 0 {
+		return nil, ErrNoProvider
+	}
+	return providers, nil
+}
+
+// build a provider by name, an empty model selects the one configured for the provider
+func NewProvider(cfg *config.Config, name, model string) (Provider, error) {
+	switch name {
+	case "openai":
+		return NewOpenAIProvider(cfg.OpenAIBaseURL, cfg.OpenAIAPIKey, cmp.Or(model, cfg.OpenAIModel)), nil
+	case "anthropic":
+		return NewAnthropicProvider(cfg.AnthropicBaseURL, cfg.AnthropicAPIKey, cmp.Or(model, cfg.AnthropicModel)), nil
+	case "ollama":
+		return NewOllamaProvider(cfg.OllamaBaseURL, cmp.Or(model, cfg.OllamaModel)), nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q", name)
+	}
+}
+
+// initialize the providers used by ProcessChat and ProcessStream
+func InitProvider(cfg *config.Config) error {
+	providers, err := NewProviders(cfg)
+	if err != nil {
+		return err
+	}
+	SetProviders(providers...)
+	for i, provider := range providers {
+		log.Info().Int("position", i).Str("provider", provider.Name()).Str("model", provider.Model()).Msg("LLM provider initialized")
+	}
+
+	for _, entry := range cfg.LLMAllowedModels {
+		name, model, _ := strings.Cut(entry, ":")
+		if model == "" {
+			return fmt.Errorf("allowed model %q has no model name", entry)
+		}
+		provider, err := NewProvider(cfg, name, model)
+		if err != nil {
+			return err
+		}
+		AllowModels(provider)
+	}
+	return nil
+}
+
+// replace the active providers with a single one, nil removes them all
+func SetProvider(provider Provider) {
+	if provider == nil {
+		SetProviders()
+		return
+	}
+	SetProviders(provider)
+}
+
+// replace the active providers with a fallback chain, tried in order, only the chain's models are allowed afterwards
+func SetProviders(providers ...Provider) {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	activeProviders = providers
+	allowedModels = make(map[string]Provider)
+	for _, provider := range providers {
+		if _, ok := allowedModels[provider.Model()]; !ok {
+			allowedModels[provider.Model()] = provider
+		}
+	}
+}
+
+// let clients ask for the models of providers besides those of the fallback chain
+func AllowModels(providers ...Provider) {
+	providerMutex.Lock()
+	defer providerMutex.Unlock()
+	for _, provider := range providers {
+		if _, ok := allowedModels[provider.Model()]; !ok {
+			allowedModels[provider.Model()] = provider
+		}
+	}
+}
+
+func getProviders() ([]Provider, error) {
+	providerMutex.RLock()
+	defer providerMutex.RUnlock()
+	if len(activeProviders) == 0 {
+		return nil, ErrNoProvider
+	}
+	return activeProviders, nil
+}
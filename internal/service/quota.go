@@ -0,0 +1,160 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+	"go-bot/internal/util"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	quotaMutex sync.RWMutex
+	userQuota  models.QuotaLimits
+	keyQuota   models.QuotaLimits
+	// share of a quota after which clients are warned
+	quotaSoftLimit = 0.8
+)
+
+// set the quotas of every user and every API key, and the percentage of a quota after which clients are warned
+func ConfigureQuotas(user, key models.QuotaLimits, softLimitPercent int) {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	userQuota, keyQuota = user, key
+	if softLimitPercent > 0 && softLimitPercent <= 100 {
+		quotaSoftLimit = float64(softLimitPercent) / 100
+	}
+}
+
+// a request naming no user would be answered for a new one, with a fresh quota every time
+var ErrUserRequired = errors.New("requests must name their user while per-user quotas are enforced")
+
+// whether users have quotas, so requests must name theirs
+func userQuotaEnforced() bool {
+	quotaMutex.RLock()
+	defer quotaMutex.RUnlock()
+	return !userQuota.IsZero()
+}
+
+// QuotaExceededError rejects a request whose user or API key has used up one of its quotas
+type QuotaExceededError struct {
+	Status models.QuotaStatus
+}
+
+func (e *QuotaExceededError) Error() string {
+	scope := "user"
+	if e.Status.Scope == models.UsageGroupKey {
+		scope = "API key"
+	}
+	return fmt.Sprintf("%s of the %s exceeded", e.Status.Describe(), scope)
+}
+
+func (e *QuotaExceededError) HTTPStatus() int {
+	return http.StatusTooManyRequests
+}
+
+func (e *QuotaExceededError) ErrorCode() string {
+	return "quota_exceeded"
+}
+
+// check what the user and API key of a request used so far against their quotas. The standing against the quota
+// closest to its limit is returned, nil when no quota applies, with a QuotaExceededError once one is used up.
+// Usage is counted when an answer is saved, so the request that crosses a limit is still answered.
+func checkQuota(ctx context.Context, store db.ChatStore, userID string) (*models.QuotaStatus, error) {
+	quotaMutex.RLock()
+	scopes := []struct {
+		groupBy, group string
+		limits         models.QuotaLimits
+	}{
+		{models.UsageGroupUser, userID, userQuota},
+		{models.UsageGroupKey, util.APIKeyID(ctx), keyQuota},
+	}
+	softLimit := quotaSoftLimit
+	quotaMutex.RUnlock()
+
+	var tightest *models.QuotaStatus
+	for _, scope := range scopes {
+		if scope.group == "" || scope.limits.IsZero() {
+			continue
+		}
+		statuses, err := quotaStatuses(ctx, store, scope.groupBy, scope.group, scope.limits)
+		if err != nil {
+			log.Error().Err(err).Str("scope", scope.groupBy).Msg("Failed to load usage for quota check")
+			return nil, err
+		}
+		for _, status := range statuses {
+			status.Warning = status.Used >= softLimit*status.Limit
+			if tightest == nil || tighter(status, *tightest) {
+				tightest = &status
+			}
+		}
+	}
+
+	if tightest != nil && tightest.Exceeded() {
+		log.Warn().
+			Str("scope", tightest.Scope).
+			Str("period", tightest.Period).
+			Str("unit", tightest.Unit).
+			Float64("limit", tightest.Limit).
+			Float64("used", tightest.Used).
+			Msg("Quota exceeded, request rejected")
+		return tightest, &QuotaExceededError{Status: *tightest}
+	}
+	return tightest, nil
+}
+
+// standing of one user or API key against each of its quotas
+func quotaStatuses(ctx context.Context, store db.ChatStore, groupBy, group string, limits models.QuotaLimits) ([]models.QuotaStatus, error) {
+	now := time.Now().UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	periods := []struct {
+		name         string
+		start, reset time.Time
+		tokens       int
+		cost         float64
+	}{
+		{models.QuotaPeriodDaily, day, day.AddDate(0, 0, 1), limits.DailyTokens, limits.DailyCost},
+		{models.QuotaPeriodMonthly, month, month.AddDate(0, 1, 0), limits.MonthlyTokens, limits.MonthlyCost},
+	}
+
+	var statuses []models.QuotaStatus
+	for _, period := range periods {
+		if period.tokens <= 0 && period.cost <= 0 {
+			continue
+		}
+		used, err := store.GetUsageTotal(ctx, groupBy, group, period.start, period.reset)
+		if err != nil {
+			return nil, err
+		}
+		status := models.QuotaStatus{Scope: groupBy, Period: period.name, Reset: period.reset}
+		if period.tokens > 0 {
+			status.Unit, status.Limit, status.Used = models.QuotaUnitTokens, float64(period.tokens), float64(used.TotalTokens)
+			statuses = append(statuses, status)
+		}
+		if period.cost > 0 {
+			status.Unit, status.Limit, status.Used = models.QuotaUnitUSD, period.cost, used.Cost
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// whether a is closer to its limit than b. Of exceeded quotas the one lasting longest counts, so clients
+// retrying after its reset are not turned away again.
+func tighter(a, b models.QuotaStatus) bool {
+	if a.Exceeded() != b.Exceeded() {
+		return a.Exceeded()
+	}
+	if a.Exceeded() {
+		return a.Reset.After(b.Reset)
+	}
+	return a.Used/a.Limit > b.Used/b.Limit
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// retries after the first attempt
+	maxRetries = 2
+	// backoff before the first retry, doubled for every further one
+	retryBaseDelay = 500 * time.Millisecond
+	// cap on the backoff, longer Retry-After delays are not waited for
+	retryMaxDelay = 10 * time.Second
+)
+
+// set how failed LLM calls are retried
+func ConfigureRetries(retries int, baseDelay, maxDelay time.Duration) {
+	if retries >= 0 {
+		maxRetries = retries
+	}
+	if baseDelay > 0 {
+		retryBaseDelay = baseDelay
+	}
+	if maxDelay > 0 {
+		retryMaxDelay = maxDelay
+	}
+}
+
+// send a request until it succeeds, fails for good or runs out of retries. Only the request itself is retried,
+// a streamed body is handed over as soon as it starts, so nothing already delivered to a client is ever repeated.
+func sendWithRetry(ctx context.Context, provider string, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+
+		var providerErr *ProviderError
+		switch {
+		case err != nil:
+			// the caller gave up, there is nothing to retry for
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			providerErr = classifyTransportError(provider, err)
+		case resp.StatusCode >= http.StatusBadRequest:
+			providerErr = classifyResponse(provider, resp)
+		default:
+			return resp, nil
+		}
+
+		if !providerErr.Retryable() || attempt >= maxRetries {
+			return nil, providerErr
+		}
+
+		delay := retryDelay(attempt, providerErr.RetryAfter)
+		if delay > retryMaxDelay {
+			log.Warn().Err(providerErr).Dur("retry_after", providerErr.RetryAfter).Msg("Backend asked to wait longer than allowed, giving up")
+			return nil, providerErr
+		}
+
+		log.Warn().
+			Err(providerErr).
+			Int("attempt", attempt+1).
+			Dur("delay", delay).
+			Msg("LLM call failed, retrying")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// exponential backoff with full jitter, a Retry-After delay is used as is
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	// with many retries the doubling overflows, it is at the cap long before that
+	backoff := retryMaxDelay
+	if attempt < 63 {
+		if doubled := retryBaseDelay << attempt; doubled>>attempt == retryBaseDelay {
+			backoff = min(doubled, retryMaxDelay)
+		}
+	}
+	return rand.N(backoff) + 1
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
@@ -0,0 +1,211 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go-bot/internal/models"
+
+	"github.com/rs/zerolog/log"
+)
+
+// how long an answer keeps generating without a client attached, and stays replayable after it ends
+const DefaultStreamResumeWindow = 30 * time.Second
+
+var ErrStreamNotFound = errors.New("stream not found")
+
+var (
+	streamResumeWindow = DefaultStreamResumeWindow
+
+	streams      = map[string]*streamBuffer{}
+	streamsMutex sync.Mutex
+)
+
+// set how long streams survive their clients, zero cancels generation as soon as the last client leaves
+func ConfigureStreamResume(window time.Duration) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	if window >= 0 {
+		streamResumeWindow = window
+	}
+}
+
+// streamBuffer keeps every event of an answer being streamed so clients can reconnect and catch up
+type streamBuffer struct {
+	messageID string
+	userID    string
+	apiKeyID  string
+	window    time.Duration
+	cancel    context.CancelFunc // stops generation
+
+	mutex       sync.Mutex
+	events      []models.StreamEvent
+	finished    bool
+	changed     chan struct{} // closed and replaced whenever an event is added
+	subscribers int
+	idleTimer   *time.Timer
+}
+
+// register the buffer of a new answer, cancel stops its generation
+func newStreamBuffer(messageID, userID, apiKeyID string, cancel context.CancelFunc) *streamBuffer {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+
+	buffer := &streamBuffer{
+		messageID: messageID,
+		userID:    userID,
+		apiKeyID:  apiKeyID,
+		window:    streamResumeWindow,
+		cancel:    cancel,
+		changed:   make(chan struct{}),
+	}
+	streams[messageID] = buffer
+	return buffer
+}
+
+func lookupStream(messageID string) (*streamBuffer, bool) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	buffer, ok := streams[messageID]
+	return buffer, ok
+}
+
+func removeStream(buffer *streamBuffer) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	if streams[buffer.messageID] == buffer {
+		delete(streams, buffer.messageID)
+	}
+}
+
+// add an event, event IDs count up from 1 in the order events are added
+func (b *streamBuffer) append(event models.StreamEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	event.ID = len(b.events) + 1
+	b.events = append(b.events, event)
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// mark the answer as complete, it stays available to reconnecting clients for the resume window
+func (b *streamBuffer) finish() {
+	b.mutex.Lock()
+	b.finished = true
+	close(b.changed)
+	b.changed = make(chan struct{})
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+	}
+	b.mutex.Unlock()
+
+	time.AfterFunc(b.window, func() { removeStream(b) })
+}
+
+// deliver the events after the given ID, then follow the answer live until it ends or ctx is cancelled
+func (b *streamBuffer) subscribe(ctx context.Context, afterID int) <-chan models.StreamEvent {
+	b.attach()
+
+	events := make(chan models.StreamEvent)
+	go func() {
+		defer close(events)
+		defer b.detach()
+
+		next := afterID
+		for {
+			b.mutex.Lock()
+			pending := b.events[min(next, len(b.events)):]
+			finished := b.finished
+			changed := b.changed
+			b.mutex.Unlock()
+
+			for _, event := range pending {
+				select {
+				case events <- event:
+					next = event.ID
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if len(pending) > 0 {
+				continue
+			}
+			if finished {
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+func (b *streamBuffer) attach() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.subscribers++
+	if b.idleTimer != nil {
+		b.idleTimer.Stop()
+		b.idleTimer = nil
+	}
+}
+
+// once the last client leaves, generation is cancelled unless one comes back within the resume window
+func (b *streamBuffer) detach() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.subscribers--
+	if b.subscribers > 0 || b.finished {
+		return
+	}
+	if b.window == 0 {
+		b.cancel()
+		return
+	}
+
+	log.Debug().Str("messageID", b.messageID).Dur("window", b.window).Msg("Stream client left, waiting for it to resume")
+	b.idleTimer = time.AfterFunc(b.window, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.subscribers == 0 && !b.finished {
+			b.cancel()
+		}
+	})
+}
+
+// reattach to an answer of the user, replaying the events after lastEventID before following it live
+func ResumeStream(ctx context.Context, userID, messageID string, lastEventID int) (<-chan models.StreamEvent, error) {
+	buffer, ok := lookupStream(messageID)
+	if !ok || buffer.userID != userID || !keyMayAccess(ctx, buffer.apiKeyID) {
+		return nil, ErrStreamNotFound
+	}
+
+	log.Debug().
+		Str("messageID", messageID).
+		Int("lastEventID", lastEventID).
+		Msg("Resuming stream")
+
+	return buffer.subscribe(ctx, lastEventID), nil
+}
+
+// stop generating an answer of the user, its partial response is saved as interrupted
+func CancelStream(ctx context.Context, userID, messageID string) error {
+	buffer, ok := lookupStream(messageID)
+	if !ok || buffer.userID != userID || !keyMayAccess(ctx, buffer.apiKeyID) {
+		return ErrStreamNotFound
+	}
+
+	log.Debug().Str("messageID", messageID).Msg("Cancelling stream")
+	buffer.cancel()
+	return nil
+}
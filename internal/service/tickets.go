@@ -0,0 +1,61 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// how long a stream ticket may be used after it was issued
+const StreamTicketLifetime = 30 * time.Second
+
+const streamTicketPrefix = "gbt_"
+
+// stream ticket stands in for an API key on connections browsers open without custom headers,
+// it is single use and keyed by its hash like managed keys
+type streamTicket struct {
+	keyID     string
+	expiresAt time.Time
+}
+
+var (
+	streamTickets      = map[string]streamTicket{}
+	streamTicketsMutex sync.Mutex
+)
+
+// issue a ticket for the API key, redeemable once within StreamTicketLifetime
+func IssueStreamTicket(keyID string) (string, time.Time, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", time.Time{}, err
+	}
+	ticket := streamTicketPrefix + hex.EncodeToString(secret)
+	now := time.Now()
+	expiresAt := now.Add(StreamTicketLifetime)
+
+	streamTicketsMutex.Lock()
+	defer streamTicketsMutex.Unlock()
+	// tickets that were never used are dropped as new ones are issued
+	for hash, issued := range streamTickets {
+		if !now.Before(issued.expiresAt) {
+			delete(streamTickets, hash)
+		}
+	}
+	streamTickets[HashAPIKey(ticket)] = streamTicket{keyID: keyID, expiresAt: expiresAt}
+	return ticket, expiresAt, nil
+}
+
+// use up a ticket, returning the ID of the key it was issued to, ErrUnauthorized when it is unknown, used or expired
+func RedeemStreamTicket(ticket string) (string, error) {
+	hash := HashAPIKey(ticket)
+
+	streamTicketsMutex.Lock()
+	defer streamTicketsMutex.Unlock()
+	issued, ok := streamTickets[hash]
+	delete(streamTickets, hash)
+	if !ok || !time.Now().Before(issued.expiresAt) {
+		return "", ErrUnauthorized
+	}
+	return issued.keyID, nil
+}
@@ -0,0 +1,17 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"go-bot/internal/models"
+)
+
+// spend of the messages saved in [from, to) per user, API key or model (models.UsageGroup*)
+func UsageReport(ctx context.Context, from, to time.Time, groupBy string) ([]models.UsageTotal, error) {
+	store, err := getStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.SumUsage(ctx, from, to, groupBy)
+}
@@ -0,0 +1,44 @@
+package util
+
+import "context"
+
+type contextKey string
+
+const (
+	requestIDKey contextKey = "request_id"
+	tenantKey    contextKey = "tenant"
+	apiKeyIDKey  contextKey = "api_key_id"
+)
+
+// attach the ID of the incoming request to the context
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// return the request ID carried by the context, empty when there is none
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// attach the tenant the request is made for to the context
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// return the tenant carried by the context, empty when there is none
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
+
+// attach the ID of the API key the request was authenticated with to the context
+func WithAPIKeyID(ctx context.Context, keyID string) context.Context {
+	return context.WithValue(ctx, apiKeyIDKey, keyID)
+}
+
+// return the API key ID carried by the context, empty when there is none
+func APIKeyID(ctx context.Context) string {
+	keyID, _ := ctx.Value(apiKeyIDKey).(string)
+	return keyID
+}
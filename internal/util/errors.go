@@ -1,12 +1,34 @@
 package util
 
-import "github.com/gin-gonic/gin"
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HTTPError is an error that knows the status and machine-readable code it should be reported with
+type HTTPError interface {
+	error
+	HTTPStatus() int
+	ErrorCode() string
+}
 
 // sends a JSON-formatted error response
 func RespondWithError(c *gin.Context, code int, message string) {
 	c.JSON(code, gin.H{"error": message})
 }
 
+// sends an error response for err, HTTP errors set the status and add their code, anything else is a 500
+func RespondWithHTTPError(c *gin.Context, err error, message string) {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		c.JSON(httpErr.HTTPStatus(), gin.H{"error": message, "code": httpErr.ErrorCode()})
+		return
+	}
+	RespondWithError(c, http.StatusInternalServerError, message)
+}
+
 // send a generic JSON response with a message
 func RespondWithMessage(c *gin.Context, code int, message string) {
 	c.JSON(code, gin.H{"message": message})
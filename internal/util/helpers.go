@@ -2,9 +2,9 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
@@ -31,6 +31,14 @@ func LogRequestOrResponse(c *gin.Context, duration time.Duration, isResponse boo
 		Str("path", c.Request.URL.Path).
 		Str("client_ip", c.ClientIP())
 
+	ctx := c.Request.Context()
+	if requestID := RequestID(ctx); requestID != "" {
+		logger = logger.Str("request_id", requestID)
+	}
+	if tenant := Tenant(ctx); tenant != "" {
+		logger = logger.Str("tenant", tenant)
+	}
+
 	if isResponse {
 		logger = logger.
 			Int("status", c.Writer.Status()).
@@ -41,21 +49,28 @@ func LogRequestOrResponse(c *gin.Context, duration time.Duration, isResponse boo
 	logger.Msg("http lifecycle event")
 }
 
-func SendOpenAIRequest(payload interface{}, stream bool) (*http.Response, error) {
+// send a JSON POST request to an LLM backend, streaming requests get no client timeout and end with the context
+func SendJSONRequest(ctx context.Context, url string, headers map[string]string, payload interface{}, stream bool) (*http.Response, error) {
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to marshal payload")
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to create OpenAI request")
+		log.Error().Err(err).Str("url", url).Msg("Failed to create LLM request")
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+os.Getenv("OPENAI_API_KEY"))
 	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	// let upstream logs be correlated with ours
+	if requestID := RequestID(ctx); requestID != "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
 
 	if stream {
 		req.Header.Set("Accept", "text/event-stream")
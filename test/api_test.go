@@ -2,32 +2,491 @@ package test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"go-bot/internal/api"
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+	"go-bot/internal/util"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+const testAPIKey = "a7d93eded416cfc6631847132dab0ef8226d2854c865284da5c0d107e3af96b2"
+
+// initialize a router backed by an in-memory store and a fake provider
+func setupRouter(t *testing.T, provider *FakeProvider) *gin.Engine {
+	t.Setenv("API_KEY", testAPIKey)
+	setupService(t, provider)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api.RegisterRoutes(router)
+	return router
+}
+
+// a context carrying the ID requests made with testAPIKey are attributed to
+func testAPIKeyContext() context.Context {
+	return util.WithAPIKeyID(context.Background(), "key_"+service.HashAPIKey(testAPIKey)[:12])
+}
+
 func TestHandleChat(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+
 	// mock request
 	req := httptest.NewRequest("POST", "/chat", bytes.NewBuffer([]byte(`{"user_id": "123", "message": "Hello!"}`)))
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-API-KEY", "a7d93eded416cfc6631847132dab0ef8226d2854c865284da5c0d107e3af96b2")
+	req.Header.Set("X-API-KEY", testAPIKey)
 
 	// mock response recorder
 	w := httptest.NewRecorder()
 
-	// initialize router
-	router := gin.Default()
-	api.RegisterRoutes(router)
-
 	// perform the request
 	router.ServeHTTP(w, req)
 
 	// assert the status code
 	assert.Equal(t, http.StatusOK, w.Code) // set status 200
+
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "Hi there!", body["response"])
+	assert.Equal(t, "123", body["user_id"])
+	assert.NotEmpty(t, body["conversation_id"])
+}
+
+func TestHandleChatRequiresAPIKey(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+
+	req := httptest.NewRequest("POST", "/chat", bytes.NewBuffer([]byte(`{"message": "Hello!"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+
+	// a request ID sent by the client is kept
+	req := httptest.NewRequest("GET", "/status", nil)
+	req.Header.Set("X-Request-ID", "req-123")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, "req-123", w.Header().Get("X-Request-ID"))
+
+	// otherwise one is generated
+	req = httptest.NewRequest("GET", "/status", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.NotEmpty(t, w.Header().Get("X-Request-ID"))
+}
+
+func TestConversationEndpoints(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-KEY", testAPIKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "/chat", `{"user_id": "123", "message": "Hello!"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var chat map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &chat))
+	id := chat["conversation_id"]
+
+	w = send("GET", "/conversations?user_id=123", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), id)
+
+	w = send("GET", "/conversations/"+id+"/messages?user_id=123", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Hi there!")
+
+	// other users cannot see the conversation
+	w = send("GET", "/conversations/"+id+"/messages?user_id=456", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = send("PATCH", "/conversations/"+id+"?user_id=123", `{"title": "Greetings", "archived": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"title":"Greetings"`)
+
+	w = send("GET", "/conversations?user_id=123", "")
+	assert.NotContains(t, w.Body.String(), id)
+
+	w = send("DELETE", "/conversations/"+id+"?user_id=123", "")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = send("DELETE", "/conversations/"+id+"?user_id=123", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHandleStream(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Chunks: []string{"Hello", " there", "\n"}})
+
+	req := httptest.NewRequest("POST", "/stream", bytes.NewBuffer([]byte(`{"user_id": "123", "message": "Hello!"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := newStreamRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream"))
+
+	// every event is named after its type and carries a JSON payload
+	var (
+		text  strings.Builder
+		types []string
+	)
+	for i, block := range strings.Split(strings.TrimSpace(w.Body.String()), "\n\n") {
+		lines := strings.SplitN(block, "\n", 3)
+		assert.Len(t, lines, 3)
+
+		var event models.StreamEvent
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data:")), &event))
+		assert.Equal(t, fmt.Sprintf("id:%d", i+1), lines[0])
+		assert.Equal(t, "event:"+event.Type, lines[1])
+
+		types = append(types, event.Type)
+		text.WriteString(event.Text)
+
+		// only deltas carry an index, the first one included
+		if event.Type == models.StreamEventDelta {
+			assert.Contains(t, lines[2], fmt.Sprintf(`"index":%d`, i-1))
+		} else {
+			assert.NotContains(t, lines[2], `"index"`)
+		}
+	}
+	assert.Equal(t, []string{"start", "delta", "delta", "delta", "usage", "done"}, types)
+	assert.Equal(t, "Hello there\n", text.String())
+}
+
+func TestResumeStream(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Chunks: []string{"Hello", " there"}})
+
+	req := httptest.NewRequest("POST", "/stream", bytes.NewBuffer([]byte(`{"user_id": "123", "message": "Hello!"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := newStreamRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var start models.StreamEvent
+	firstEvent := strings.SplitN(w.Body.String(), "\n\n", 2)[0]
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(strings.Split(firstEvent, "\n")[2], "data:")), &start))
+
+	// reconnecting after the first delta replays everything that followed it
+	req = httptest.NewRequest("GET", "/stream/"+start.MessageID+"?user_id=123", nil)
+	req.Header.Set("X-API-KEY", testAPIKey)
+	req.Header.Set("Last-Event-ID", "2")
+	w = newStreamRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "id:3\nevent:delta\n"))
+	assert.Contains(t, w.Body.String(), "event:done")
+	assert.NotContains(t, w.Body.String(), "event:start")
+
+	// streams of other users are not disclosed
+	req = httptest.NewRequest("GET", "/stream/"+start.MessageID+"?user_id=456", nil)
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w = newStreamRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// EventSource cannot send the key, a stream ticket in the query string stands in for it
+	req = httptest.NewRequest("GET", "/stream/"+start.MessageID+"?user_id=123&last_event_id=4&ticket="+issueStreamTicket(t, router), nil)
+	w = newStreamRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "id:5\n"))
+
+	// tickets only stand in for keys on the routes browsers cannot send them to
+	req = httptest.NewRequest("POST", "/chat?ticket="+issueStreamTicket(t, router), bytes.NewBufferString(`{"message": "Hello!"}`))
+	chat := httptest.NewRecorder()
+	router.ServeHTTP(chat, req)
+	assert.Equal(t, http.StatusUnauthorized, chat.Code)
+
+	req = httptest.NewRequest("GET", "/stream/"+start.MessageID+"?user_id=123", nil)
+	req.Header.Set("X-API-KEY", testAPIKey)
+	req.Header.Set("Last-Event-ID", "abc")
+	w = newStreamRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHandleChatSurfacesProviderErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		kind   service.ErrorKind
+		status int
+		code   string
+	}{
+		"rate limited":   {service.ErrorRateLimited, http.StatusTooManyRequests, "rate_limited"},
+		"context length": {service.ErrorContextLength, http.StatusBadRequest, "context_length_exceeded"},
+		"upstream auth":  {service.ErrorAuth, http.StatusBadGateway, "upstream_auth_failed"},
+		"timeout":        {service.ErrorTimeout, http.StatusGatewayTimeout, "upstream_timeout"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			router := setupRouter(t, &FakeProvider{Err: &service.ProviderError{Provider: "fake", Kind: test.kind}})
+
+			// /chat and /stream answer service failures alike
+			for path, message := range map[string]string{"/chat": "Failed to process chat request", "/stream": "Streaming failed"} {
+				req := httptest.NewRequest("POST", path, bytes.NewBuffer([]byte(`{"message": "Hello!"}`)))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-API-KEY", testAPIKey)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, test.status, w.Code, path)
+				var body map[string]string
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.Equal(t, test.code, body["code"], path)
+				assert.Equal(t, message, body["error"], path)
+			}
+		})
+	}
+}
+
+func TestHandleChatRejectsInvalidParameters(t *testing.T) {
+	provider := &FakeProvider{Reply: "Hi"}
+	router := setupRouter(t, provider)
+
+	req := httptest.NewRequest("POST", "/chat", bytes.NewBuffer([]byte(`{"message": "Hello!", "temperature": 3}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "temperature must be between 0 and 2")
+	assert.Empty(t, provider.Received())
+}
+
+const testAdminKey = "admin-test-key"
+
+func TestUsageReport(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!", ModelName: "gpt-4o", Usage: &models.Usage{PromptTokens: 1000, CompletionTokens: 100, TotalTokens: 1100}})
+
+	for _, user := range []string{"alice", "bob", "alice"} {
+		req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"user_id": "`+user+`", "message": "Hello!"}`))
+		req.Header.Set("X-API-KEY", testAPIKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	report := func(query, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/usage"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// the service key does not open the admin API
+	assert.Equal(t, http.StatusForbidden, report("", testAPIKey).Code)
+	assert.Equal(t, http.StatusUnauthorized, report("", "wrong-key").Code)
+	assert.Equal(t, http.StatusBadRequest, report("?group_by=tenant", testAdminKey).Code)
+	assert.Equal(t, http.StatusBadRequest, report("?from=yesterday", testAdminKey).Code)
+
+	var body struct {
+		GroupBy  string              `json:"group_by"`
+		Currency string              `json:"currency"`
+		Usage    []models.UsageTotal `json:"usage"`
+		Total    models.UsageTotal   `json:"total"`
+	}
+	w := report("", testAdminKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "user", body.GroupBy)
+	assert.Equal(t, "USD", body.Currency)
+	if assert.Len(t, body.Usage, 2) {
+		assert.Equal(t, "alice", body.Usage[0].Group)
+		assert.Equal(t, 2, body.Usage[0].Messages)
+		assert.InDelta(t, 0.007, body.Usage[0].Cost, 1e-9)
+	}
+	assert.Equal(t, 3, body.Total.Messages)
+	assert.InDelta(t, 0.0105, body.Total.Cost, 1e-9)
+
+	// exchanges are attributed to the key they were requested with, never to the key itself
+	w = report("?group_by=key", testAdminKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	if assert.Len(t, body.Usage, 1) {
+		assert.True(t, strings.HasPrefix(body.Usage[0].Group, "key_"))
+		assert.NotContains(t, w.Body.String(), testAPIKey)
+	}
+
+	// a period without exchanges reports nothing
+	w = report("?from=2020-01-01&to=2020-01-31&group_by=model", testAdminKey)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Empty(t, body.Usage)
+}
+
+func TestUsageReportWithoutAdminKey(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "")
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+
+	// without ADMIN_API_KEY only managed keys granted the admin scope open the admin API
+	req := httptest.NewRequest("GET", "/admin/usage", nil)
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestQuotaHeaders(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!", ModelName: "gpt-4o", Usage: &models.Usage{PromptTokens: 1000, CompletionTokens: 1000, TotalTokens: 2000}})
+	// every exchange costs $0.0125, the key may spend $0.03 a month whoever asks
+	service.ConfigureQuotas(models.QuotaLimits{}, models.QuotaLimits{MonthlyCost: 0.03}, 50)
+
+	chat := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"user_id": "`+user+`", "message": "Hello!"}`))
+		req.Header.Set("X-API-KEY", testAPIKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := chat("alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "key", w.Header().Get("X-Quota-Scope"))
+	assert.Equal(t, "monthly", w.Header().Get("X-Quota-Period"))
+	assert.Equal(t, "usd", w.Header().Get("X-Quota-Unit"))
+	assert.Equal(t, "0.0300", w.Header().Get("X-Quota-Limit"))
+	assert.Equal(t, "0.0300", w.Header().Get("X-Quota-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("X-Quota-Reset"))
+	assert.Empty(t, w.Header().Get("X-Quota-Warning"))
+
+	w = chat("bob")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0.0175", w.Header().Get("X-Quota-Remaining"))
+
+	// past the soft limit responses carry a warning
+	w = chat("carol")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0.0050", w.Header().Get("X-Quota-Remaining"))
+	assert.Equal(t, "83% of the monthly spend quota used", w.Header().Get("X-Quota-Warning"))
+
+	w = chat("dave")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0.0000", w.Header().Get("X-Quota-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	var body map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "quota_exceeded", body["code"])
+	assert.Equal(t, "monthly spend quota of the API key exceeded", body["error"])
+
+	// the OpenAI-compatible API is limited too
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello!"}]}`))
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "quota_exceeded")
+}
+
+func TestHandleChatRequiresUserUnderUserQuota(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	service.ConfigureQuotas(models.QuotaLimits{DailyTokens: 100}, models.QuotaLimits{}, 80)
+
+	req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"message": "Hello!"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "must name their user")
+}
+
+func TestManagedAPIKeys(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!", Chunks: []string{"Hi"}})
+
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-KEY", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// only admin keys manage keys
+	assert.Equal(t, http.StatusForbidden, send("GET", "/admin/keys", testAPIKey, "").Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/admin/keys", testAdminKey, `{"name": "bad", "scopes": ["everything"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/admin/keys", testAdminKey, `{"name": "", "scopes": ["chat"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, send("POST", "/admin/keys", testAdminKey, `{"name": "late", "scopes": ["chat"], "expires_at": "2020-01-01T00:00:00Z"}`).Code)
+
+	var created struct {
+		Key    string        `json:"key"`
+		APIKey models.APIKey `json:"api_key"`
+	}
+	w := send("POST", "/admin/keys", testAdminKey, `{"name": "billing", "scopes": ["chat"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.Key, created.APIKey.Prefix))
+	assert.Equal(t, []string{"chat"}, created.APIKey.Scopes)
+	assert.NotContains(t, w.Body.String(), "hash")
+
+	// the key works within its scopes only
+	assert.Equal(t, http.StatusOK, send("POST", "/chat", created.Key, `{"message": "Hello!"}`).Code)
+	assert.Equal(t, http.StatusForbidden, send("POST", "/stream", created.Key, `{"message": "Hello!"}`).Code)
+	assert.Equal(t, http.StatusForbidden, send("POST", "/v1/chat/completions", created.Key, `{"stream": true, "messages": [{"role": "user", "content": "Hello!"}]}`).Code)
+	assert.Equal(t, http.StatusForbidden, send("GET", "/admin/usage", created.Key, "").Code)
+
+	// listings never show the key itself
+	w = send("GET", "/admin/keys", testAdminKey, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), created.APIKey.Prefix)
+	assert.NotContains(t, w.Body.String(), created.Key)
+
+	// exchanges are attributed to the managed key
+	w = send("GET", "/admin/usage?group_by=key", testAdminKey, "")
+	assert.Contains(t, w.Body.String(), created.APIKey.ID.Hex())
+
+	w = send("DELETE", "/admin/keys/"+created.APIKey.ID.Hex(), testAdminKey, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "revoked_at")
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/chat", created.Key, `{"message": "Hello!"}`).Code)
+	assert.Equal(t, http.StatusNotFound, send("DELETE", "/admin/keys/"+primitive.NewObjectID().Hex(), testAdminKey, "").Code)
+}
+
+func TestExpiredAPIKeyIsRejected(t *testing.T) {
+	t.Setenv("API_KEY", testAPIKey)
+	store := setupService(t, &FakeProvider{Reply: "Hi there!"})
+	router := gin.New()
+	api.RegisterRoutes(router)
+
+	// keys cannot be created already expired, so this one is stored directly
+	const key = "gb_0123456789abcdef0123456789abcdef0123456789abcdef"
+	expiresAt := time.Now().Add(-time.Minute)
+	assert.NoError(t, store.CreateAPIKey(context.Background(), models.APIKey{
+		ID: primitive.NewObjectID(), Name: "expired", Prefix: key[:11], Hash: service.HashAPIKey(key),
+		Scopes: []string{models.APIKeyScopeChat}, CreatedAt: expiresAt.Add(-time.Hour), ExpiresAt: &expiresAt,
+	}))
+
+	_, err := service.AuthenticateAPIKey(context.Background(), key)
+	assert.ErrorIs(t, err, service.ErrUnauthorized)
+
+	req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"message": "Hello!"}`))
+	req.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
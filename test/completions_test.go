@@ -0,0 +1,207 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// post an OpenAI chat completion request authenticated the way OpenAI SDKs do
+func postCompletion(t *testing.T, provider *FakeProvider, body string) *streamRecorder {
+	router := setupRouter(t, provider)
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	w := newStreamRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestChatCompletions(t *testing.T) {
+	provider := &FakeProvider{Reply: "Paris"}
+	w := postCompletion(t, provider, `{
+		"model": "fake-model",
+		"user": "123",
+		"messages": [
+			{"role": "developer", "content": "Answer briefly."},
+			{"role": "user", "content": [{"type": "text", "text": "What is the capital of France?"}]}
+		]
+	}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response models.CompletionResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "chat.completion", response.Object)
+	assert.True(t, strings.HasPrefix(response.ID, "chatcmpl-"))
+	assert.Equal(t, "fake-model", response.Model)
+	assert.Len(t, response.Choices, 1)
+	assert.Equal(t, "assistant", response.Choices[0].Message.Role)
+	assert.Equal(t, models.CompletionContent("Paris"), response.Choices[0].Message.Content)
+	assert.Equal(t, "stop", *response.Choices[0].FinishReason)
+	assert.Positive(t, response.Usage.TotalTokens)
+
+	// the client's conversation is sent as-is
+	assert.Equal(t, []service.Message{
+		{Role: "system", Content: "Answer briefly."},
+		{Role: "user", Content: "What is the capital of France?"},
+	}, provider.Received()[0])
+
+	// and the exchange is saved like any other chat
+	conversationID := w.Header().Get("X-Conversation-ID")
+	assert.NotEmpty(t, conversationID)
+	_, messages, err := service.GetConversationMessages(testAPIKeyContext(), "123", conversationID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "What is the capital of France?", messages[0].Message)
+	assert.Equal(t, "Paris", messages[0].Response)
+}
+
+func TestChatCompletionsStream(t *testing.T) {
+	w := postCompletion(t, &FakeProvider{Chunks: []string{"Hello", " there"}}, `{
+		"model": "fake-model",
+		"stream": true,
+		"stream_options": {"include_usage": true},
+		"messages": [{"role": "user", "content": "Hi"}]
+	}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var (
+		chunks []models.CompletionResponse
+		done   bool
+	)
+	for _, block := range strings.Split(strings.TrimSpace(w.Body.String()), "\n\n") {
+		data := strings.TrimPrefix(block, "data:")
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk models.CompletionResponse
+		assert.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		assert.Equal(t, "chat.completion.chunk", chunk.Object)
+		chunks = append(chunks, chunk)
+	}
+	assert.True(t, done)
+
+	// role, two content deltas, finish reason, usage
+	assert.Len(t, chunks, 5)
+	assert.Equal(t, "assistant", chunks[0].Choices[0].Delta.Role)
+	assert.Equal(t, "Hello", chunks[1].Choices[0].Delta.Content)
+	assert.Equal(t, " there", chunks[2].Choices[0].Delta.Content)
+	assert.Equal(t, "stop", *chunks[3].Choices[0].FinishReason)
+	assert.Empty(t, chunks[4].Choices)
+	assert.Positive(t, chunks[4].Usage.TotalTokens)
+	assert.Equal(t, chunks[0].ID, chunks[4].ID)
+}
+
+func TestChatCompletionsRejectsInvalidRequests(t *testing.T) {
+	for name, body := range map[string]string{
+		"no messages":     `{"model": "fake-model", "messages": []}`,
+		"unknown role":    `{"model": "fake-model", "messages": [{"role": "tool", "content": "42"}]}`,
+		"no user message": `{"model": "fake-model", "messages": [{"role": "system", "content": "Be nice."}]}`,
+		"image content":   `{"model": "fake-model", "messages": [{"role": "user", "content": [{"type": "image_url"}]}]}`,
+		"top_p":           `{"model": "fake-model", "top_p": 1.5, "messages": [{"role": "user", "content": "Hi"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := postCompletion(t, &FakeProvider{Reply: "Hi"}, body)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+
+			var response models.CompletionError
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			assert.Equal(t, "invalid_request_error", response.Error.Type)
+		})
+	}
+}
+
+func TestChatCompletionsSamplingParams(t *testing.T) {
+	provider := &FakeProvider{Reply: "Paris"}
+	w := postCompletion(t, provider, `{
+		"temperature": 0.5,
+		"max_completion_tokens": 64,
+		"stop": "END",
+		"messages": [{"role": "user", "content": "What is the capital of France?"}]
+	}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// without a model the default one answers
+	var response models.CompletionResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "fake-model", response.Model)
+
+	params := provider.ReceivedParams()
+	assert.Len(t, params, 1)
+	assert.Equal(t, 0.5, *params[0].Temperature)
+	assert.Equal(t, 64, *params[0].MaxTokens)
+	assert.Equal(t, models.StopSequences{"END"}, params[0].Stop)
+}
+
+func TestChatCompletionsRejectsUnknownModels(t *testing.T) {
+	provider := &FakeProvider{Reply: "Paris"}
+	w := postCompletion(t, provider, `{"model": "gpt-unknown", "messages": [{"role": "user", "content": "Hi"}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var response models.CompletionError
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "invalid_request_error", response.Error.Type)
+	if assert.NotNil(t, response.Error.Code) {
+		assert.Equal(t, "model_not_found", *response.Error.Code)
+	}
+	assert.Contains(t, response.Error.Message, "gpt-unknown")
+	assert.Empty(t, provider.Received())
+}
+
+func TestChatCompletionsStreamFailure(t *testing.T) {
+	w := postCompletion(t, &FakeProvider{Chunks: []string{"Hello"}, StreamErr: &service.ProviderError{Provider: "fake", Kind: service.ErrorServer}}, `{
+		"model": "fake-model",
+		"stream": true,
+		"messages": [{"role": "user", "content": "Hi"}]
+	}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the error chunk ends the answer, no finish reason OpenAI SDKs do not know follows it
+	blocks := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	assert.Equal(t, "data:[DONE]", blocks[len(blocks)-1])
+	var failure models.CompletionError
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(blocks[len(blocks)-2], "data:")), &failure))
+	assert.Equal(t, "server_error", failure.Error.Type)
+	assert.NotContains(t, w.Body.String(), `"finish_reason":"error"`)
+}
+
+func TestChatCompletionsStreamCancelled(t *testing.T) {
+	server := httptest.NewServer(setupRouter(t, &FakeProvider{Chunks: []string{"Once"}, Hold: make(chan struct{})}))
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL+"/v1/chat/completions",
+		strings.NewReader(`{"model": "fake-model", "stream": true, "user": "123", "messages": [{"role": "user", "content": "Tell me a story."}]}`))
+	assert.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+testAPIKey)
+	response, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	var first models.CompletionResponse
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "data:")), &first))
+	assert.NoError(t, service.CancelStream(testAPIKeyContext(), "123", strings.TrimPrefix(first.ID, "chatcmpl-")))
+
+	// the answer cancelled on our side finishes like a stopped one
+	rest, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Contains(t, string(rest), `"finish_reason":"stop"`)
+	assert.NotContains(t, string(rest), "cancelled")
+}
@@ -0,0 +1,75 @@
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountTokens(t *testing.T) {
+	assert.Equal(t, 2, service.CountTokens("gpt-4-turbo", "hello world"))
+	assert.Equal(t, 2, service.CountTokens("gpt-4o", "hello world"))
+}
+
+func TestContextWindow(t *testing.T) {
+	assert.Equal(t, 128000, service.ContextWindow("gpt-4-turbo"))
+	assert.Equal(t, 128000, service.ContextWindow("gpt-4o-mini"))
+	assert.Equal(t, 8192, service.ContextWindow("gpt-4"))
+	assert.Equal(t, 8192, service.ContextWindow("unknown-model"))
+}
+
+func TestBuildContextKeepsNewestExchangesWithinBudget(t *testing.T) {
+	// each exchange costs roughly 3000 tokens, so only two fit in the default 8192 window
+	long := strings.Repeat(" word", 1500)
+	history := []models.ChatMessage{
+		{Message: "oldest" + long, Response: "first" + long},
+		{Message: "older" + long, Response: "second" + long},
+		{Message: "newer" + long, Response: "third" + long},
+		{Message: "newest" + long, Response: "fourth" + long},
+	}
+
+	messages := service.BuildContext("unknown-model", "question", history, "system", models.GenerationParams{})
+
+	assert.Len(t, messages, 6)
+	assert.Equal(t, "system", messages[0].Content)
+	assert.True(t, strings.HasPrefix(messages[1].Content, "newer"))
+	assert.True(t, strings.HasPrefix(messages[3].Content, "newest"))
+	assert.Equal(t, "question", messages[5].Content)
+}
+
+func TestBuildContextUsesWholeHistoryWhenItFits(t *testing.T) {
+	history := []models.ChatMessage{
+		{Message: "Hello", Response: "Hi!"},
+		{Message: "How are you?", Response: "Fine."},
+	}
+
+	messages := service.BuildContext("gpt-4-turbo", "Great", history, "system", models.GenerationParams{})
+
+	assert.Equal(t, service.BuildMessages("Great", history, "system"), messages)
+}
+
+func TestBuildContextLeavesRoomForMaxTokens(t *testing.T) {
+	// each exchange costs roughly 1500 tokens, all four fit in the default 8192 window besides the default reserve
+	long := strings.Repeat(" word", 750)
+	history := []models.ChatMessage{
+		{Message: "oldest" + long, Response: "first" + long},
+		{Message: "older" + long, Response: "second" + long},
+		{Message: "newer" + long, Response: "third" + long},
+		{Message: "newest" + long, Response: "fourth" + long},
+	}
+	assert.Len(t, service.BuildContext("unknown-model", "question", history, "system", models.GenerationParams{}), 10)
+
+	// an answer of up to 4096 tokens leaves room for two
+	maxTokens := 4096
+	messages := service.BuildContext("unknown-model", "question", history, "system", models.GenerationParams{MaxTokens: &maxTokens})
+	assert.Len(t, messages, 6)
+	assert.True(t, strings.HasPrefix(messages[1].Content, "newer"))
+
+	// a smaller max_tokens does not shrink the reserve
+	maxTokens = 16
+	assert.Len(t, service.BuildContext("unknown-model", "question", history, "system", models.GenerationParams{MaxTokens: &maxTokens}), 10)
+}
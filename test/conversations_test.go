@@ -0,0 +1,212 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go-bot/internal/db"
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// send an authenticated request to the router
+func sendConversationRequest(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// start a conversation for the user and return its ID
+func startConversation(t *testing.T, router *gin.Engine, userID, message string) string {
+	w := sendConversationRequest(router, "POST", "/chat", `{"user_id": "`+userID+`", "message": "`+message+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var chat map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &chat))
+	return chat["conversation_id"]
+}
+
+func TestConversationEndpointsRequireUserID(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	id := startConversation(t, router, "123", "Hello!")
+
+	for _, request := range []struct{ method, path, body string }{
+		{"GET", "/conversations", ""},
+		{"GET", "/conversations/" + id + "/messages", ""},
+		{"PATCH", "/conversations/" + id, `{"title": "Greetings"}`},
+		{"DELETE", "/conversations/" + id, ""},
+	} {
+		w := sendConversationRequest(router, request.method, request.path, request.body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, request.method+" "+request.path)
+		assert.Contains(t, w.Body.String(), "user_id is required")
+	}
+}
+
+func TestListConversationsIncludesArchivedOnRequest(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	kept := startConversation(t, router, "123", "Hello!")
+	archived := startConversation(t, router, "123", "Goodbye!")
+	startConversation(t, router, "456", "Someone else")
+
+	w := sendConversationRequest(router, "PATCH", "/conversations/"+archived+"?user_id=123", `{"archived": true}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var listed struct {
+		Conversations []models.Conversation `json:"conversations"`
+	}
+	w = sendConversationRequest(router, "GET", "/conversations?user_id=123", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	if assert.Len(t, listed.Conversations, 1) {
+		assert.Equal(t, kept, listed.Conversations[0].ID.Hex())
+	}
+
+	w = sendConversationRequest(router, "GET", "/conversations?user_id=123&include_archived=true", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Len(t, listed.Conversations, 2)
+
+	// a user without conversations gets an empty list
+	w = sendConversationRequest(router, "GET", "/conversations?user_id=789", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Empty(t, listed.Conversations)
+}
+
+func TestConversationMessagesLimit(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	id := startConversation(t, router, "123", "First")
+	w := sendConversationRequest(router, "POST", "/chat", `{"user_id": "123", "conversation_id": "`+id+`", "message": "Second"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var reloaded struct {
+		Messages []models.ChatMessage `json:"messages"`
+	}
+	w = sendConversationRequest(router, "GET", "/conversations/"+id+"/messages?user_id=123", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reloaded))
+	if assert.Len(t, reloaded.Messages, 2) {
+		assert.Equal(t, "First", reloaded.Messages[0].Message)
+		assert.Equal(t, "Second", reloaded.Messages[1].Message)
+	}
+
+	w = sendConversationRequest(router, "GET", "/conversations/"+id+"/messages?user_id=123&limit=1", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reloaded))
+	if assert.Len(t, reloaded.Messages, 1) {
+		assert.Equal(t, "Second", reloaded.Messages[0].Message)
+	}
+
+	for _, limit := range []string{"0", "-1", "501", "many"} {
+		w = sendConversationRequest(router, "GET", "/conversations/"+id+"/messages?user_id=123&limit="+limit, "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, limit)
+	}
+}
+
+func TestUpdateConversationValidation(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	id := startConversation(t, router, "123", "Hello!")
+
+	w := sendConversationRequest(router, "PATCH", "/conversations/"+id+"?user_id=123", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Nothing to update")
+
+	w = sendConversationRequest(router, "PATCH", "/conversations/"+id+"?user_id=123", `{"title": "  "}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Title cannot be empty")
+
+	w = sendConversationRequest(router, "PATCH", "/conversations/"+id+"?user_id=123", `{"title": 42}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// only the owner may rename the conversation
+	w = sendConversationRequest(router, "PATCH", "/conversations/"+id+"?user_id=456", `{"title": "Mine now"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestConversationNotFound(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	id := startConversation(t, router, "123", "Hello!")
+
+	for _, path := range []string{"/conversations/not-an-id", "/conversations/000000000000000000000000"} {
+		w := sendConversationRequest(router, "GET", path+"/messages?user_id=123", "")
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+		w = sendConversationRequest(router, "PATCH", path+"?user_id=123", `{"archived": true}`)
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+		w = sendConversationRequest(router, "DELETE", path+"?user_id=123", "")
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+
+	// other users cannot delete the conversation
+	w := sendConversationRequest(router, "DELETE", "/conversations/"+id+"?user_id=456", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = sendConversationRequest(router, "GET", "/conversations/"+id+"/messages?user_id=123", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestConversationsAreLimitedToTheirAPIKey(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	id := startConversation(t, router, "123", "Hello!")
+
+	_, otherKey, err := service.CreateAPIKey(context.Background(), models.APIKeyRequest{Name: "other", Scopes: []string{models.APIKeyScopeChat}})
+	assert.NoError(t, err)
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-KEY", otherKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// another key naming the same user sees none of the conversations started with the first one
+	var listed struct {
+		Conversations []models.Conversation `json:"conversations"`
+	}
+	w := send("GET", "/conversations?user_id=123", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Empty(t, listed.Conversations)
+	assert.Equal(t, http.StatusNotFound, send("GET", "/conversations/"+id+"/messages?user_id=123", "").Code)
+	assert.Equal(t, http.StatusNotFound, send("PATCH", "/conversations/"+id+"?user_id=123", `{"title": "Mine now"}`).Code)
+	assert.Equal(t, http.StatusNotFound, send("DELETE", "/conversations/"+id+"?user_id=123", "").Code)
+	assert.Equal(t, http.StatusNotFound, send("POST", "/chat", `{"user_id": "123", "conversation_id": "`+id+`", "message": "Hi"}`).Code)
+
+	w = sendConversationRequest(router, "GET", "/conversations/"+id+"/messages?user_id=123", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Hello!")
+}
+
+// a store counting its conversation lookups
+type countingStore struct {
+	db.ChatStore
+	lookups atomic.Int32
+}
+
+func (s *countingStore) GetConversation(ctx context.Context, conversationID string) (*models.Conversation, error) {
+	s.lookups.Add(1)
+	return s.ChatStore.GetConversation(ctx, conversationID)
+}
+
+func TestConversationMessagesLoadTheConversationOnce(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	store := &countingStore{ChatStore: db.NewMemoryStore()}
+	service.SetStore(store)
+	id := startConversation(t, router, "123", "Hello!")
+
+	store.lookups.Store(0)
+	w := sendConversationRequest(router, "GET", "/conversations/"+id+"/messages?user_id=123", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var reloaded struct {
+		Conversation models.Conversation  `json:"conversation"`
+		Messages     []models.ChatMessage `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &reloaded))
+	assert.Equal(t, id, reloaded.Conversation.ID.Hex())
+	assert.Len(t, reloaded.Messages, 1)
+	assert.Equal(t, int32(1), store.lookups.Load())
+}
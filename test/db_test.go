@@ -2,6 +2,11 @@ package test
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -9,79 +14,344 @@ import (
 	"go-bot/internal/models"
 
 	"github.com/stretchr/testify/assert"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func setupTestDB() *mongo.Client {
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017") // Change to a test database
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+// chat store implementations under test, Mongo and PostgreSQL only run when MONGO_TEST_URI / POSTGRES_TEST_DSN point at a test database
+func chatStores(t *testing.T) map[string]db.ChatStore {
+	stores := map[string]db.ChatStore{"memory": db.NewMemoryStore()}
+
+	sqliteStore, err := db.NewSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
 	if err != nil {
-		panic(err)
+		t.Fatalf("failed to open SQLite store: %v", err)
+	}
+	t.Cleanup(func() { sqliteStore.Disconnect() })
+	stores["sqlite"] = sqliteStore
+
+	if dsn := os.Getenv("POSTGRES_TEST_DSN"); dsn != "" {
+		store, err := db.NewPostgresStore(dsn)
+		if err != nil {
+			t.Fatalf("failed to connect to test PostgreSQL: %v", err)
+		}
+		t.Cleanup(func() { store.Disconnect() })
+		stores["postgres"] = store
 	}
-	return client
-}
 
-func teardownTestDB(client *mongo.Client) {
-	client.Database("go-chat-backend").Drop(context.TODO())
-	client.Disconnect(context.TODO())
+	if uri := os.Getenv("MONGO_TEST_URI"); uri != "" {
+		store, err := db.NewMongoStore(uri)
+		if err != nil {
+			t.Fatalf("failed to connect to test MongoDB: %v", err)
+		}
+		t.Cleanup(func() { store.Disconnect() })
+		stores["mongo"] = store
+	}
+	return stores
 }
 
 func TestSaveChat(t *testing.T) {
-	client := setupTestDB()
-	defer teardownTestDB(client)
-
-	db.Connect("mongodb://localhost:27017") // use the same URI as your test DB
-	chat := models.ChatMessage{
-		UserID:    "test_user",
-		Message:   "Hello!",
-		Response:  "Hi there!",
-		Timestamp: time.Now(),
+	for name, store := range chatStores(t) {
+		t.Run(name, func(t *testing.T) {
+			conversation, err := store.CreateConversation(context.Background(), "test_user", "", "Greeting")
+			assert.NoError(t, err)
+
+			temperature := 0.3
+			err = store.SaveChat(context.Background(), models.ChatMessage{UserID: "test_user", ConversationID: conversation.ID.Hex(), Message: "Hello!", Response: "Hi there!", Provider: "openai", Model: "gpt-4o", Parameters: &models.GenerationParams{Temperature: &temperature, Stop: models.StopSequences{"END"}}})
+			assert.NoError(t, err)
+
+			// verify that the message was saved
+			history, err := store.GetChatHistory(context.Background(), conversation.ID.Hex(), 3)
+			assert.NoError(t, err)
+			assert.Len(t, history, 1)
+			assert.Equal(t, "test_user", history[0].UserID)
+			assert.Equal(t, conversation.ID.Hex(), history[0].ConversationID)
+			assert.Equal(t, "Hello!", history[0].Message)
+			assert.Equal(t, "Hi there!", history[0].Response)
+			assert.Equal(t, "openai", history[0].Provider)
+			assert.Equal(t, "gpt-4o", history[0].Model)
+			assert.Equal(t, &models.GenerationParams{Temperature: &temperature, Stop: models.StopSequences{"END"}}, history[0].Parameters)
+		})
+	}
+}
+
+func TestGetChatHistory(t *testing.T) {
+	for name, store := range chatStores(t) {
+		t.Run(name, func(t *testing.T) {
+			conversationID := InsertMockChats(t, store)
+			assert.NoError(t, store.SaveChat(context.Background(), models.ChatMessage{UserID: "test_user", ConversationID: conversationID, Message: "Message 3", Response: "Response 3"}))
+			assert.NoError(t, store.SaveChat(context.Background(), models.ChatMessage{UserID: "test_user", ConversationID: conversationID, Message: "Message 4", Response: "Response 4"}))
+
+			// messages of other conversations are not part of the history
+			other := InsertMockChats(t, store)
+			assert.NotEqual(t, conversationID, other)
+
+			// fetch chat history
+			history, err := store.GetChatHistory(context.Background(), conversationID, 3)
+			assert.NoError(t, err)
+			assert.Len(t, history, 3)
+			assert.Equal(t, "Message 2", history[0].Message) // Check the oldest message
+			assert.Equal(t, "Message 3", history[1].Message) // Check the second message
+			assert.Equal(t, "Message 4", history[2].Message) // Check the most recent message
+		})
+	}
+}
+
+func TestConversationLifecycle(t *testing.T) {
+	for name, store := range chatStores(t) {
+		t.Run(name, func(t *testing.T) {
+			userID := "lifecycle_user_" + name
+			first, err := store.CreateConversation(context.Background(), userID, "", "First")
+			assert.NoError(t, err)
+			second, err := store.CreateConversation(context.Background(), userID, "key_123", "Second")
+			assert.NoError(t, err)
+			loaded, err := store.GetConversation(context.Background(), second.ID.Hex())
+			assert.NoError(t, err)
+			assert.Equal(t, "key_123", loaded.APIKeyID)
+
+			// saving a message bumps the conversation to the top
+			assert.NoError(t, store.SaveChat(context.Background(), models.ChatMessage{UserID: userID, ConversationID: first.ID.Hex(), Message: "Hello", Response: "Hi"}))
+			conversations, err := store.ListConversations(context.Background(), userID, false)
+			assert.NoError(t, err)
+			assert.Len(t, conversations, 2)
+			assert.Equal(t, first.ID, conversations[0].ID)
+
+			title, archived := "Renamed", true
+			updated, err := store.UpdateConversation(context.Background(), second.ID.Hex(), models.ConversationUpdate{Title: &title, Archived: &archived})
+			assert.NoError(t, err)
+			assert.Equal(t, "Renamed", updated.Title)
+			assert.True(t, updated.Archived)
+
+			conversations, err = store.ListConversations(context.Background(), userID, false)
+			assert.NoError(t, err)
+			assert.Len(t, conversations, 1)
+			conversations, err = store.ListConversations(context.Background(), userID, true)
+			assert.NoError(t, err)
+			assert.Len(t, conversations, 2)
+
+			assert.NoError(t, store.DeleteConversation(context.Background(), first.ID.Hex()))
+			_, err = store.GetConversation(context.Background(), first.ID.Hex())
+			assert.ErrorIs(t, err, db.ErrConversationNotFound)
+			history, err := store.GetChatHistory(context.Background(), first.ID.Hex(), 10)
+			assert.NoError(t, err)
+			assert.Empty(t, history)
+
+			assert.ErrorIs(t, store.DeleteConversation(context.Background(), first.ID.Hex()), db.ErrConversationNotFound)
+		})
 	}
+}
 
-	err := db.SaveChat(chat.UserID, chat.Message, chat.Response)
+func TestMemoryStoreConcurrentSaves(t *testing.T) {
+	store := db.NewMemoryStore()
+	conversation, err := store.CreateConversation(context.Background(), "test_user", "", "Concurrent")
 	assert.NoError(t, err)
 
-	// verify that the message was saved
-	var result models.ChatMessage
-	collection := client.Database("go-chat-backend").Collection("chatSchema")
-	err = collection.FindOne(context.TODO(), bson.M{"user_id": "test_user"}).Decode(&result)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, store.SaveChat(context.Background(), models.ChatMessage{UserID: "test_user", ConversationID: conversation.ID.Hex(), Message: fmt.Sprintf("Message %d", i), Response: "ok"}))
+		}(i)
+	}
+	wg.Wait()
+
+	history, err := store.GetChatHistory(context.Background(), conversation.ID.Hex(), 100)
 	assert.NoError(t, err)
-	assert.Equal(t, chat.Message, result.Message)
-	assert.WithinDuration(t, chat.Timestamp, result.Timestamp, time.Second)
+	assert.Len(t, history, 50)
 }
 
-func TestGetChatHistory(t *testing.T) {
-	client := setupTestDB()
-	defer teardownTestDB(client)
-
-	db.Connect("mongodb://localhost:27017")
-	collection := client.Database("go-chat-backend").Collection("chatSchema")
-
-	// insert mock data
-	mockChats := []interface{}{
-		models.ChatMessage{
-			UserID:    "test_user",
-			Message:   "Message 1",
-			Response:  "Response 1",
-			Timestamp: time.Now(),
-		},
-		models.ChatMessage{
-			UserID:    "test_user",
-			Message:   "Message 2",
-			Response:  "Response 2",
-			Timestamp: time.Now(),
-		},
-	}
-	_, err := collection.InsertMany(context.TODO(), mockChats)
+func TestSQLiteStoreReopensExistingDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+
+	store, err := db.NewSQLiteStore(path)
 	assert.NoError(t, err)
+	conversationID := InsertMockChats(t, store)
+	assert.NoError(t, store.Disconnect())
 
-	// fetch chat history
-	history, err := db.GetChatHistory("test_user", 3)
+	// migrations already applied are skipped and the data is kept
+	store, err = db.NewSQLiteStore(path)
 	assert.NoError(t, err)
-	assert.Len(t, history, 3)
-	assert.Equal(t, "Hello", history[0].Message)                    // Check the oldest message
-	assert.Equal(t, "How are you?", history[1].Message)             // Check the second message
-	assert.Equal(t, "What's the weather like?", history[2].Message) // Check the most recent message
+	defer store.Disconnect()
+
+	history, err := store.GetChatHistory(context.Background(), conversationID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, "Message 1", history[0].Message)
+}
+
+func TestGetDailyUsage(t *testing.T) {
+	for name, store := range chatStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			// users are unique per run so shared test databases do not leak into the sums
+			alice, bob := "alice-"+name+"-"+primitive.NewObjectID().Hex(), "bob-"+name+"-"+primitive.NewObjectID().Hex()
+			conversation, err := store.CreateConversation(ctx, alice, "", "Usage")
+			assert.NoError(t, err)
+
+			day := time.Date(2026, 3, 14, 0, 0, 0, 0, time.UTC)
+			for _, chat := range []models.ChatMessage{
+				{UserID: alice, Timestamp: day.Add(1 * time.Hour), Usage: models.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}},
+				{UserID: alice, Timestamp: day.Add(23 * time.Hour), Usage: models.Usage{PromptTokens: 20, CompletionTokens: 10, TotalTokens: 30}},
+				{UserID: alice, Timestamp: day.Add(25 * time.Hour), Usage: models.Usage{PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2}},
+				{UserID: bob, Timestamp: day.Add(2 * time.Hour), Usage: models.Usage{PromptTokens: 7, CompletionTokens: 3, TotalTokens: 10}},
+				// outside the range
+				{UserID: alice, Timestamp: day.Add(-time.Minute), Usage: models.Usage{PromptTokens: 100, CompletionTokens: 100, TotalTokens: 200}},
+			} {
+				chat.ConversationID = conversation.ID.Hex()
+				chat.Message, chat.Response = "Hi", "Hello"
+				assert.NoError(t, store.SaveChat(ctx, chat))
+			}
+
+			usage, err := store.GetDailyUsage(ctx, alice, day, day.AddDate(0, 0, 2))
+			assert.NoError(t, err)
+			assert.Equal(t, []models.DailyUsage{
+				{UserID: alice, Day: "2026-03-14", Messages: 2, Usage: models.Usage{PromptTokens: 30, CompletionTokens: 15, TotalTokens: 45}},
+				{UserID: alice, Day: "2026-03-15", Messages: 1, Usage: models.Usage{PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2}},
+			}, usage)
+
+			// without a user every user is counted
+			usage, err = store.GetDailyUsage(ctx, "", day, day.AddDate(0, 0, 1))
+			assert.NoError(t, err)
+			var users []string
+			for _, entry := range usage {
+				if entry.UserID == alice || entry.UserID == bob {
+					users = append(users, entry.UserID)
+				}
+			}
+			assert.ElementsMatch(t, []string{alice, bob}, users)
+		})
+	}
+}
+
+func TestSumUsage(t *testing.T) {
+	for name, store := range chatStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			// groups are unique per run so shared test databases do not leak into the sums
+			run := name + "-" + primitive.NewObjectID().Hex()
+			alice, bob := "alice-"+run, "bob-"+run
+			keyA, keyB := "key_a-"+run, "key_b-"+run
+			conversation, err := store.CreateConversation(ctx, alice, "", "Spend")
+			assert.NoError(t, err)
+
+			day := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+			for _, chat := range []models.ChatMessage{
+				{UserID: alice, APIKeyID: keyA, Model: "big-" + run, Timestamp: day.Add(time.Hour), Usage: models.Usage{PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15}, Cost: 0.5},
+				{UserID: alice, APIKeyID: keyB, Model: "small-" + run, Timestamp: day.Add(2 * time.Hour), Usage: models.Usage{PromptTokens: 4, CompletionTokens: 2, TotalTokens: 6}, Cost: 0.25},
+				{UserID: bob, APIKeyID: keyB, Model: "big-" + run, Timestamp: day.Add(3 * time.Hour), Usage: models.Usage{PromptTokens: 20, CompletionTokens: 10, TotalTokens: 30}, Cost: 1},
+				// outside the range
+				{UserID: bob, APIKeyID: keyA, Model: "big-" + run, Timestamp: day.AddDate(0, 0, 1), Usage: models.Usage{PromptTokens: 100, CompletionTokens: 100, TotalTokens: 200}, Cost: 10},
+			} {
+				chat.ConversationID = conversation.ID.Hex()
+				chat.Message, chat.Response = "Hi", "Hello"
+				assert.NoError(t, store.SaveChat(ctx, chat))
+			}
+
+			// keep the groups of this run, in the order they were reported
+			sum := func(groupBy string) []models.UsageTotal {
+				totals, err := store.SumUsage(ctx, day, day.AddDate(0, 0, 1), groupBy)
+				assert.NoError(t, err)
+				var own []models.UsageTotal
+				for _, total := range totals {
+					if strings.HasSuffix(total.Group, run) {
+						own = append(own, total)
+					}
+				}
+				return own
+			}
+
+			users := sum(models.UsageGroupUser)
+			if assert.Len(t, users, 2) {
+				assert.Equal(t, bob, users[0].Group)
+				assert.InDelta(t, 1, users[0].Cost, 1e-9)
+				assert.Equal(t, alice, users[1].Group)
+				assert.Equal(t, 2, users[1].Messages)
+				assert.Equal(t, models.Usage{PromptTokens: 14, CompletionTokens: 7, TotalTokens: 21}, users[1].Usage)
+				assert.InDelta(t, 0.75, users[1].Cost, 1e-9)
+			}
+
+			keys := sum(models.UsageGroupKey)
+			if assert.Len(t, keys, 2) {
+				assert.Equal(t, keyB, keys[0].Group)
+				assert.InDelta(t, 1.25, keys[0].Cost, 1e-9)
+				assert.Equal(t, keyA, keys[1].Group)
+			}
+
+			modelTotals := sum(models.UsageGroupModel)
+			if assert.Len(t, modelTotals, 2) {
+				assert.Equal(t, "big-"+run, modelTotals[0].Group)
+				assert.Equal(t, 2, modelTotals[0].Messages)
+			}
+
+			_, err = store.SumUsage(ctx, day, day.AddDate(0, 0, 1), "tenant")
+			assert.Error(t, err)
+
+			total, err := store.GetUsageTotal(ctx, models.UsageGroupKey, keyB, day, day.AddDate(0, 0, 1))
+			assert.NoError(t, err)
+			assert.Equal(t, keyB, total.Group)
+			assert.Equal(t, 2, total.Messages)
+			assert.Equal(t, models.Usage{PromptTokens: 24, CompletionTokens: 12, TotalTokens: 36}, total.Usage)
+			assert.InDelta(t, 1.25, total.Cost, 1e-9)
+
+			// nothing used is a zero total
+			total, err = store.GetUsageTotal(ctx, models.UsageGroupUser, "nobody-"+run, day, day.AddDate(0, 0, 1))
+			assert.NoError(t, err)
+			assert.Zero(t, total.Messages)
+			assert.Zero(t, total.Cost)
+		})
+	}
+}
+
+func TestAPIKeyStore(t *testing.T) {
+	for name, store := range chatStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			now := time.Now().UTC().Truncate(time.Millisecond)
+			expiresAt := now.Add(24 * time.Hour)
+
+			// hashes are unique per run so shared test databases do not collide
+			older := models.APIKey{ID: primitive.NewObjectID(), Name: "older", Prefix: "gb_older", Hash: "hash-older-" + primitive.NewObjectID().Hex(),
+				Scopes: []string{models.APIKeyScopeChat}, CreatedAt: now.Add(-time.Minute)}
+			newer := models.APIKey{ID: primitive.NewObjectID(), Name: "newer", Prefix: "gb_newer", Hash: "hash-newer-" + primitive.NewObjectID().Hex(),
+				Scopes: []string{models.APIKeyScopeChat, models.APIKeyScopeAdmin}, CreatedAt: now, ExpiresAt: &expiresAt}
+			assert.NoError(t, store.CreateAPIKey(ctx, older))
+			assert.NoError(t, store.CreateAPIKey(ctx, newer))
+
+			key, err := store.GetAPIKeyByHash(ctx, newer.Hash)
+			assert.NoError(t, err)
+			assert.Equal(t, newer.ID, key.ID)
+			assert.Equal(t, "newer", key.Name)
+			assert.Equal(t, newer.Scopes, key.Scopes)
+			assert.True(t, newer.CreatedAt.Equal(key.CreatedAt))
+			if assert.NotNil(t, key.ExpiresAt) {
+				assert.True(t, expiresAt.Equal(*key.ExpiresAt))
+			}
+			assert.Nil(t, key.RevokedAt)
+
+			_, err = store.GetAPIKeyByHash(ctx, "unknown")
+			assert.ErrorIs(t, err, db.ErrAPIKeyNotFound)
+
+			keys, err := store.ListAPIKeys(ctx)
+			assert.NoError(t, err)
+			var ids []primitive.ObjectID
+			for _, listed := range keys {
+				if listed.ID == older.ID || listed.ID == newer.ID {
+					ids = append(ids, listed.ID)
+				}
+			}
+			assert.Equal(t, []primitive.ObjectID{newer.ID, older.ID}, ids)
+
+			revoked, err := store.RevokeAPIKey(ctx, older.ID.Hex(), now)
+			assert.NoError(t, err)
+			if assert.NotNil(t, revoked.RevokedAt) {
+				assert.True(t, now.Equal(*revoked.RevokedAt))
+			}
+			// revoking again keeps the first revocation
+			revoked, err = store.RevokeAPIKey(ctx, older.ID.Hex(), now.Add(time.Hour))
+			assert.NoError(t, err)
+			assert.True(t, now.Equal(*revoked.RevokedAt))
+
+			_, err = store.RevokeAPIKey(ctx, primitive.NewObjectID().Hex(), now)
+			assert.ErrorIs(t, err, db.ErrAPIKeyNotFound)
+		})
+	}
 }
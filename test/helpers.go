@@ -2,30 +2,157 @@ package test
 
 import (
 	"context"
+	"net/http/httptest"
+	"sync"
 	"testing"
-	"time"
 
 	"github.com/stretchr/testify/assert"
+	"go-bot/internal/db"
 	"go-bot/internal/models"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go-bot/internal/service"
 )
 
-// InsertMockChats adds mock chat messages to the test database.
-func InsertMockChats(t *testing.T, collection *mongo.Collection) {
-	mockChats := []interface{}{
-		models.ChatMessage{
-			UserID:    "test_user",
-			Message:   "Message 1",
-			Response:  "Response 1",
-			Timestamp: time.Now(),
-		},
-		models.ChatMessage{
-			UserID:    "test_user",
-			Message:   "Message 2",
-			Response:  "Response 2",
-			Timestamp: time.Now(),
-		},
-	}
-	_, err := collection.InsertMany(context.TODO(), mockChats)
+// InsertMockChats adds mock chat messages to a new conversation of the test user and returns its ID.
+func InsertMockChats(t *testing.T, store db.ChatStore) string {
+	conversation, err := store.CreateConversation(context.Background(), "test_user", "", "Test conversation")
 	assert.NoError(t, err)
+
+	conversationID := conversation.ID.Hex()
+	assert.NoError(t, store.SaveChat(context.Background(), models.ChatMessage{UserID: "test_user", ConversationID: conversationID, Message: "Message 1", Response: "Response 1"}))
+	assert.NoError(t, store.SaveChat(context.Background(), models.ChatMessage{UserID: "test_user", ConversationID: conversationID, Message: "Message 2", Response: "Response 2"}))
+	return conversationID
+}
+
+// FakeProvider is an LLM provider answering with canned content and recording what it received.
+type FakeProvider struct {
+	Reply     string
+	Chunks    []string
+	StreamErr error         // reported after the chunks when set
+	Hold      chan struct{} // when set, the stream only ends once it is closed or the context is cancelled
+	Accept    chan struct{} // when set, Stream only returns once it is closed, like a backend slow to answer
+	Err       error         // returned by Complete and Stream when set
+	Label     string        // reported by Name, "fake" when empty
+	ModelName string        // reported by Model, "fake-model" when empty
+	Usage     *models.Usage // reported with the answer when set, otherwise usage is estimated
+
+	mutex    sync.Mutex
+	received [][]service.Message
+	params   []models.GenerationParams
+}
+
+func (p *FakeProvider) Name() string {
+	if p.Label != "" {
+		return p.Label
+	}
+	return "fake"
+}
+
+func (p *FakeProvider) Model() string {
+	if p.ModelName != "" {
+		return p.ModelName
+	}
+	return "fake-model"
+}
+
+func (p *FakeProvider) Complete(ctx context.Context, messages []service.Message, params models.GenerationParams) (*service.Completion, error) {
+	p.record(messages, params)
+	if p.Err != nil {
+		return nil, p.Err
+	}
+	return &service.Completion{Text: p.Reply, FinishReason: "stop", Usage: p.Usage}, nil
+}
+
+func (p *FakeProvider) Stream(ctx context.Context, messages []service.Message, params models.GenerationParams) (<-chan service.StreamChunk, error) {
+	p.record(messages, params)
+	if p.Accept != nil {
+		select {
+		case <-p.Accept:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if p.Err != nil {
+		return nil, p.Err
+	}
+	chunks := make(chan service.StreamChunk)
+	go func() {
+		defer close(chunks)
+
+		stream := make([]service.StreamChunk, 0, len(p.Chunks)+2)
+		for _, chunk := range p.Chunks {
+			stream = append(stream, service.StreamChunk{Text: chunk})
+		}
+		if p.StreamErr != nil {
+			stream = append(stream, service.StreamChunk{Err: p.StreamErr})
+		} else {
+			if p.Usage != nil {
+				stream = append(stream, service.StreamChunk{Usage: p.Usage})
+			}
+			stream = append(stream, service.StreamChunk{FinishReason: "stop"})
+		}
+
+		for i, chunk := range stream {
+			if i == len(p.Chunks) && p.Hold != nil {
+				select {
+				case <-p.Hold:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case chunks <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return chunks, nil
+}
+
+func (p *FakeProvider) record(messages []service.Message, params models.GenerationParams) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.received = append(p.received, messages)
+	p.params = append(p.params, params)
+}
+
+// Received returns the conversations sent to the provider so far.
+func (p *FakeProvider) Received() [][]service.Message {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.received
+}
+
+// ReceivedParams returns the generation parameters sent to the provider so far.
+func (p *FakeProvider) ReceivedParams() []models.GenerationParams {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.params
+}
+
+// setupService wires the service layer to an in-memory store and a fake provider.
+func setupService(t *testing.T, provider service.Provider) *db.MemoryStore {
+	store := db.NewMemoryStore()
+	service.SetStore(store)
+	service.SetProvider(provider)
+	service.ConfigureStreamResume(service.DefaultStreamResumeWindow)
+	t.Cleanup(func() {
+		service.SetStore(nil)
+		service.SetProvider(nil)
+		service.ConfigureQuotas(models.QuotaLimits{}, models.QuotaLimits{}, 80)
+	})
+	return store
+}
+
+// streamRecorder is a response recorder usable with gin's Context.Stream, which requires http.CloseNotifier.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func newStreamRecorder() *streamRecorder {
+	return &streamRecorder{httptest.NewRecorder()}
+}
+
+func (r *streamRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
 }
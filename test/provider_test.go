@@ -0,0 +1,288 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+	"go-bot/internal/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// drain a provider stream into its text chunks and finish reason
+func collectChunks(chunks <-chan service.StreamChunk) ([]string, string) {
+	var (
+		collected    []string
+		finishReason string
+	)
+	for chunk := range chunks {
+		if chunk.Text != "" {
+			collected = append(collected, chunk.Text)
+		}
+		if chunk.FinishReason != "" {
+			finishReason = chunk.FinishReason
+		}
+	}
+	return collected, finishReason
+}
+
+func TestAnthropicProviderStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/messages", r.URL.Path)
+		assert.Equal(t, "test-key", r.Header.Get("x-api-key"))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message_start\ndata: {\"type\":\"message_start\"}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n")
+		fmt.Fprint(w, "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\" there\"}}\n\n")
+		fmt.Fprint(w, "event: message_delta\ndata: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"max_tokens\"}}\n\n")
+		fmt.Fprint(w, "event: message_stop\ndata: {\"type\":\"message_stop\"}\n\n")
+	}))
+	defer server.Close()
+
+	provider := service.NewAnthropicProvider(server.URL, "test-key", "claude-test")
+	chunks, err := provider.Stream(context.Background(), []service.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hi"},
+	}, models.GenerationParams{})
+	assert.NoError(t, err)
+	text, finishReason := collectChunks(chunks)
+	assert.Equal(t, []string{"Hello", " there"}, text)
+	assert.Equal(t, "length", finishReason)
+}
+
+func TestOpenAIProviderStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\" there\"}}]}\n\n")
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	chunks, err := provider.Stream(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+	assert.NoError(t, err)
+	text, finishReason := collectChunks(chunks)
+	assert.Equal(t, []string{"Hello", " there"}, text)
+	assert.Equal(t, "stop", finishReason)
+}
+
+func TestOllamaProviderStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/chat", r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":"Hello"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":" there"},"done":false}`)
+		fmt.Fprintln(w, `{"message":{"role":"assistant","content":""},"done":true,"done_reason":"stop"}`)
+	}))
+	defer server.Close()
+
+	provider := service.NewOllamaProvider(server.URL, "llama-test")
+	chunks, err := provider.Stream(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+	assert.NoError(t, err)
+	text, finishReason := collectChunks(chunks)
+	assert.Equal(t, []string{"Hello", " there"}, text)
+	assert.Equal(t, "stop", finishReason)
+}
+
+func TestOpenAIProviderCompleteUsesRequestContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "req-123", r.Header.Get("X-Request-ID"))
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"Hello there"}}]}`)
+	}))
+	defer server.Close()
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	ctx := util.WithRequestID(context.Background(), "req-123")
+	response, err := provider.Complete(ctx, []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello there", response.Text)
+
+	// a cancelled request never reaches the backend
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = provider.Complete(cancelled, []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestProvidersSendGenerationParams(t *testing.T) {
+	temperature, topP, maxTokens, seed := 1.5, 0.9, 256, int64(42)
+	params := models.GenerationParams{Temperature: &temperature, TopP: &topP, MaxTokens: &maxTokens, Stop: models.StopSequences{"END"}, Seed: &seed}
+
+	for name, test := range map[string]struct {
+		provider func(url string) service.Provider
+		reply    string
+		expected map[string]any
+	}{
+		"openai": {
+			provider: func(url string) service.Provider { return service.NewOpenAIProvider(url, "test-key", "gpt-test") },
+			reply:    `{"choices":[{"message":{"role":"assistant","content":"Hi"}}]}`,
+			expected: map[string]any{"temperature": 1.5, "top_p": 0.9, "max_tokens": 256.0, "stop": []any{"END"}, "seed": 42.0},
+		},
+		"anthropic": {
+			provider: func(url string) service.Provider { return service.NewAnthropicProvider(url, "test-key", "claude-test") },
+			reply:    `{"content":[{"type":"text","text":"Hi"}],"stop_reason":"end_turn"}`,
+			// temperatures are capped at 1 and seeds are not supported
+			expected: map[string]any{"temperature": 1.0, "top_p": 0.9, "max_tokens": 256.0, "stop_sequences": []any{"END"}, "seed": nil},
+		},
+		"ollama": {
+			provider: func(url string) service.Provider { return service.NewOllamaProvider(url, "llama-test") },
+			reply:    `{"message":{"role":"assistant","content":"Hi"},"done":true}`,
+			expected: map[string]any{"options": map[string]any{"temperature": 1.5, "top_p": 0.9, "num_predict": 256.0, "stop": []any{"END"}, "seed": 42.0}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var payload map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, test.reply)
+			}))
+			defer server.Close()
+
+			response, err := test.provider(server.URL).Complete(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, params)
+			assert.NoError(t, err)
+			assert.Equal(t, "Hi", response.Text)
+			for key, value := range test.expected {
+				assert.Equal(t, value, payload[key], key)
+			}
+		})
+	}
+}
+
+func TestProvidersReportUsage(t *testing.T) {
+	for name, test := range map[string]struct {
+		provider func(url string) service.Provider
+		reply    string
+	}{
+		"openai": {
+			provider: func(url string) service.Provider { return service.NewOpenAIProvider(url, "test-key", "gpt-test") },
+			reply:    `{"choices":[{"message":{"role":"assistant","content":"Hi"},"finish_reason":"length"}],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}`,
+		},
+		"anthropic": {
+			provider: func(url string) service.Provider { return service.NewAnthropicProvider(url, "test-key", "claude-test") },
+			reply:    `{"content":[{"type":"text","text":"Hi"}],"stop_reason":"max_tokens","usage":{"input_tokens":12,"output_tokens":3}}`,
+		},
+		"ollama": {
+			provider: func(url string) service.Provider { return service.NewOllamaProvider(url, "llama-test") },
+			reply:    `{"message":{"role":"assistant","content":"Hi"},"done":true,"done_reason":"length","prompt_eval_count":12,"eval_count":3}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, test.reply)
+			}))
+			defer server.Close()
+
+			completion, err := test.provider(server.URL).Complete(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+			assert.NoError(t, err)
+			assert.Equal(t, "length", completion.FinishReason)
+			assert.Equal(t, &models.Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}, completion.Usage)
+		})
+	}
+}
+
+func TestProviderStreamsReportUsage(t *testing.T) {
+	for name, test := range map[string]struct {
+		provider func(url string) service.Provider
+		stream   string
+		check    func(t *testing.T, payload map[string]any)
+	}{
+		"openai": {
+			provider: func(url string) service.Provider { return service.NewOpenAIProvider(url, "test-key", "gpt-test") },
+			stream: "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\n" +
+				"data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n" +
+				"data: {\"choices\":[],\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":3,\"total_tokens\":15}}\n\n" +
+				"data: [DONE]\n\n",
+			check: func(t *testing.T, payload map[string]any) {
+				assert.Equal(t, map[string]any{"include_usage": true}, payload["stream_options"])
+			},
+		},
+		"anthropic": {
+			provider: func(url string) service.Provider { return service.NewAnthropicProvider(url, "test-key", "claude-test") },
+			stream: "data: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":12,\"output_tokens\":1}}}\n\n" +
+				"data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hi\"}}\n\n" +
+				"data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"},\"usage\":{\"output_tokens\":3}}\n\n" +
+				"data: {\"type\":\"message_stop\"}\n\n",
+		},
+		"ollama": {
+			provider: func(url string) service.Provider { return service.NewOllamaProvider(url, "llama-test") },
+			stream: "{\"message\":{\"role\":\"assistant\",\"content\":\"Hi\"},\"done\":false}\n" +
+				"{\"message\":{\"role\":\"assistant\",\"content\":\"\"},\"done\":true,\"prompt_eval_count\":12,\"eval_count\":3}\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var payload map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+				fmt.Fprint(w, test.stream)
+			}))
+			defer server.Close()
+
+			chunks, err := test.provider(server.URL).Stream(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+			assert.NoError(t, err)
+
+			var usage *models.Usage
+			for chunk := range chunks {
+				assert.NoError(t, chunk.Err)
+				if chunk.Usage != nil {
+					usage = chunk.Usage
+				}
+			}
+			assert.Equal(t, &models.Usage{PromptTokens: 12, CompletionTokens: 3, TotalTokens: 15}, usage)
+			if test.check != nil {
+				test.check(t, payload)
+			}
+		})
+	}
+}
+
+func TestOpenAIProviderStreamsWithoutStreamOptionsWhenRejected(t *testing.T) {
+	var calls atomic.Int32
+	var withOptions []bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var payload map[string]any
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		_, ok := payload["stream_options"]
+		withOptions = append(withOptions, ok)
+		// like servers validating the request against a strict schema
+		if ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": {"message": "stream_options: Extra inputs are not permitted", "type": "BadRequestError"}}`)
+			return
+		}
+		fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hi\"}}]}\n\ndata: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	for range 2 {
+		chunks, err := provider.Stream(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+		if !assert.NoError(t, err) {
+			return
+		}
+		text, _ := collectChunks(chunks)
+		assert.Equal(t, []string{"Hi"}, text)
+	}
+
+	// the option is dropped once rejected and left out of later streams
+	assert.Equal(t, []bool{true, false, false}, withOptions)
+	assert.Equal(t, int32(3), calls.Load())
+}
@@ -0,0 +1,229 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go-bot/internal/api"
+	"go-bot/internal/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// rate limit backends under test, Mongo only runs when MONGO_TEST_URI points at a test database
+func rateLimitBackends(t *testing.T) map[string]ratelimit.Backend {
+	backends := map[string]ratelimit.Backend{"memory": ratelimit.NewMemoryBackend()}
+
+	if uri := os.Getenv("MONGO_TEST_URI"); uri != "" {
+		backend, err := ratelimit.NewMongoBackend(uri)
+		if err != nil {
+			t.Fatalf("failed to connect to test MongoDB: %v", err)
+		}
+		t.Cleanup(func() { backend.Disconnect() })
+		backends["mongo"] = backend
+	}
+	return backends
+}
+
+func TestRateLimitBackendWindows(t *testing.T) {
+	for name, backend := range rateLimitBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			// keys are unique per run so shared test databases do not leak into the counts
+			key := "user:" + primitive.NewObjectID().Hex()
+			window := time.Minute
+			start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+			for want := int64(1); want <= 3; want++ {
+				current, previous, err := backend.Hit(ctx, key, start, window)
+				assert.NoError(t, err)
+				assert.Equal(t, want, current)
+				assert.Zero(t, previous)
+			}
+
+			// the next window starts over and remembers the one before
+			current, previous, err := backend.Hit(ctx, key, start.Add(window), window)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), current)
+			assert.Equal(t, int64(3), previous)
+
+			// after an idle window nothing is carried over
+			current, previous, err = backend.Hit(ctx, key, start.Add(3*window), window)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), current)
+			assert.Zero(t, previous)
+		})
+	}
+}
+
+func TestLimiterReportsTightestLimit(t *testing.T) {
+	limiter := ratelimit.NewLimiter(ratelimit.NewMemoryBackend(), ratelimit.Rules{Window: time.Hour, PerUser: 2, PerIP: 10})
+	ctx := context.Background()
+
+	result, err := limiter.Allow(ctx, ratelimit.Subject{UserID: "alice", IP: "10.0.0.1"})
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, "user", result.Scope)
+	assert.Equal(t, 2, result.Limit)
+	assert.Equal(t, 1, result.Remaining)
+
+	result, _ = limiter.Allow(ctx, ratelimit.Subject{UserID: "alice", IP: "10.0.0.1"})
+	assert.True(t, result.Allowed)
+	assert.Zero(t, result.Remaining)
+
+	result, _ = limiter.Allow(ctx, ratelimit.Subject{UserID: "alice", IP: "10.0.0.1"})
+	assert.False(t, result.Allowed)
+	assert.Positive(t, result.Reset)
+
+	// another user behind the same address only shares the IP limit
+	result, _ = limiter.Allow(ctx, ratelimit.Subject{UserID: "bob", IP: "10.0.0.1"})
+	assert.True(t, result.Allowed)
+	assert.Equal(t, "user", result.Scope)
+
+	// limits without a value are off
+	result, err = limiter.Allow(ctx, ratelimit.Subject{KeyID: "key_abc"})
+	assert.NoError(t, err)
+	assert.Nil(t, result)
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	api.SetRateLimiter(ratelimit.NewLimiter(ratelimit.NewMemoryBackend(), ratelimit.Rules{Window: time.Hour, PerUser: 2, PerIP: 4}))
+	t.Cleanup(func() { api.SetRateLimiter(nil) })
+
+	chat := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"user_id": "`+user+`", "message": "Hello!"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-KEY", testAPIKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := chat("alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("RateLimit-Reset"))
+	// the body still reaches the handler after the user was read from it
+	assert.Contains(t, w.Body.String(), "Hi there!")
+
+	assert.Equal(t, http.StatusOK, chat("alice").Code)
+
+	w = chat("alice")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "0", w.Header().Get("RateLimit-Remaining"))
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "rate_limit_exceeded")
+
+	// every request from the address counts, the rejected one included
+	assert.Equal(t, http.StatusOK, chat("bob").Code)
+	w = chat("carol")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "4", w.Header().Get("RateLimit-Limit"))
+
+	// health checks are not limited
+	req := httptest.NewRequest("GET", "/status", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
+
+func TestRateLimitCountsRequestsWithBadKeys(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	t.Cleanup(func() { api.SetRateLimiter(nil) })
+
+	for _, route := range []struct{ method, path string }{{"POST", "/chat"}, {"GET", "/admin/keys"}} {
+		api.SetRateLimiter(ratelimit.NewLimiter(ratelimit.NewMemoryBackend(), ratelimit.Rules{Window: time.Hour, PerKey: 10, PerIP: 3}))
+		codes := []int{}
+		for range 4 {
+			req := httptest.NewRequest(route.method, route.path, nil)
+			req.Header.Set("X-API-KEY", "gb_not-a-key")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			codes = append(codes, w.Code)
+		}
+		// guessing keys is limited per address before the key is looked up
+		assert.Equal(t, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}, codes, route.path)
+	}
+
+	// the IP limit is reported when it is closer than the key limit
+	api.SetRateLimiter(ratelimit.NewLimiter(ratelimit.NewMemoryBackend(), ratelimit.Rules{Window: time.Hour, PerKey: 10, PerIP: 3}))
+	req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"message": "Hello!"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "3", w.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "2", w.Header().Get("RateLimit-Remaining"))
+}
+
+func TestRateLimitMiddlewareLargeBody(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	api.SetRateLimiter(ratelimit.NewLimiter(ratelimit.NewMemoryBackend(), ratelimit.Rules{Window: time.Hour, PerUser: 1}))
+	t.Cleanup(func() { api.SetRateLimiter(nil) })
+
+	// the body runs far past the part read for the user
+	padding := strings.Repeat("a", 1<<20)
+	chat := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"user_id": "`+user+`", "message": "Hello!", "padding": "`+padding+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-KEY", testAPIKey)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := chat("alice")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("RateLimit-Limit"))
+	assert.Contains(t, w.Body.String(), "Hi there!")
+	assert.Equal(t, http.StatusTooManyRequests, chat("alice").Code)
+	assert.Equal(t, http.StatusOK, chat("bob").Code)
+}
+
+func TestRateLimitIgnoresForwardedForFromUntrustedPeers(t *testing.T) {
+	setupRouter(t, &FakeProvider{Reply: "Hi there!"})
+	t.Cleanup(func() { api.SetRateLimiter(nil) })
+
+	// httptest requests come from 192.0.2.1
+	for name, test := range map[string]struct {
+		trustedProxies []string
+		allowed        int
+	}{
+		"no trusted proxies": {nil, 2},
+		"trusted proxy":      {[]string{"192.0.2.0/24"}, 4},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api.SetRateLimiter(ratelimit.NewLimiter(ratelimit.NewMemoryBackend(), ratelimit.Rules{Window: time.Hour, PerIP: 2}))
+			router := gin.New()
+			assert.NoError(t, router.SetTrustedProxies(test.trustedProxies))
+			api.RegisterRoutes(router)
+
+			allowed := 0
+			for i := range 4 {
+				req := httptest.NewRequest("POST", "/chat", strings.NewReader(`{"message": "Hello!"}`))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-API-KEY", testAPIKey)
+				req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i+1))
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+				if w.Code == http.StatusOK {
+					allowed++
+				}
+			}
+			// a forged address only gets a fresh limit when the proxy sending it is trusted
+			assert.Equal(t, test.allowed, allowed)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// retry quickly in tests, restoring the defaults afterwards
+func fastRetries(t *testing.T, retries int) {
+	service.ConfigureRetries(retries, time.Millisecond, 50*time.Millisecond)
+	t.Cleanup(func() { service.ConfigureRetries(2, 500*time.Millisecond, 10*time.Second) })
+}
+
+// serve the given statuses in turn, then a successful OpenAI answer
+func flakyOpenAIServer(t *testing.T, calls *atomic.Int32, statuses ...int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1))
+		if call <= len(statuses) {
+			w.WriteHeader(statuses[call-1])
+			fmt.Fprint(w, `{"error": {"message": "try again", "type": "server_error"}}`)
+			return
+		}
+		if r.Header.Get("Accept") == "text/event-stream" {
+			fmt.Fprint(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"}}]}\n\ndata: [DONE]\n\n")
+			return
+		}
+		fmt.Fprint(w, `{"choices":[{"message":{"role":"assistant","content":"Hello"}}]}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProviderRetriesTransientErrors(t *testing.T) {
+	fastRetries(t, 2)
+	var calls atomic.Int32
+	server := flakyOpenAIServer(t, &calls, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	response, err := provider.Complete(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", response.Text)
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestProviderStreamRetriesBeforeStreaming(t *testing.T) {
+	fastRetries(t, 2)
+	var calls atomic.Int32
+	server := flakyOpenAIServer(t, &calls, http.StatusBadGateway)
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	chunks, err := provider.Stream(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+	assert.NoError(t, err)
+	text, _ := collectChunks(chunks)
+	assert.Equal(t, []string{"Hello"}, text)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestProviderGivesUpAfterRetries(t *testing.T) {
+	fastRetries(t, 1)
+	var calls atomic.Int32
+	server := flakyOpenAIServer(t, &calls, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	_, err := provider.Complete(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+
+	var providerErr *service.ProviderError
+	assert.ErrorAs(t, err, &providerErr)
+	assert.Equal(t, service.ErrorServer, providerErr.Kind)
+	assert.Equal(t, http.StatusInternalServerError, providerErr.StatusCode)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestProviderRetriesPastBackoffOverflow(t *testing.T) {
+	// doubling the base delay overflows after 63 retries, the delay stays at the cap from then on
+	service.ConfigureRetries(70, time.Nanosecond, time.Nanosecond)
+	t.Cleanup(func() { service.ConfigureRetries(2, 500*time.Millisecond, 10*time.Second) })
+
+	statuses := make([]int, 70)
+	for i := range statuses {
+		statuses[i] = http.StatusServiceUnavailable
+	}
+	var calls atomic.Int32
+	server := flakyOpenAIServer(t, &calls, statuses...)
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	completion, err := provider.Complete(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", completion.Text)
+	assert.Equal(t, int32(71), calls.Load())
+}
+
+func TestProviderDoesNotRetryPermanentErrors(t *testing.T) {
+	fastRetries(t, 3)
+
+	for name, test := range map[string]struct {
+		status int
+		body   string
+		kind   service.ErrorKind
+	}{
+		"auth":           {http.StatusUnauthorized, `{"error": {"message": "Incorrect API key provided"}}`, service.ErrorAuth},
+		"context length": {http.StatusBadRequest, `{"error": {"code": "context_length_exceeded"}}`, service.ErrorContextLength},
+		"bad request":    {http.StatusBadRequest, `{"error": {"message": "Unknown parameter"}}`, service.ErrorInvalidRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+
+			provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+			_, err := provider.Complete(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+
+			var providerErr *service.ProviderError
+			assert.ErrorAs(t, err, &providerErr)
+			assert.Equal(t, test.kind, providerErr.Kind)
+			assert.Equal(t, int32(1), calls.Load())
+		})
+	}
+}
+
+func TestProviderHonorsRetryAfter(t *testing.T) {
+	fastRetries(t, 2)
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		// longer than the configured maximum delay, so the call fails right away
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	provider := service.NewOpenAIProvider(server.URL, "test-key", "gpt-test")
+	_, err := provider.Complete(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+
+	var providerErr *service.ProviderError
+	assert.ErrorAs(t, err, &providerErr)
+	assert.Equal(t, service.ErrorRateLimited, providerErr.Kind)
+	assert.Equal(t, 120*time.Second, providerErr.RetryAfter)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestProviderErrorBodies(t *testing.T) {
+	fastRetries(t, 2)
+
+	for name, test := range map[string]struct {
+		provider func(url string) service.Provider
+		status   int
+		body     string
+		kind     service.ErrorKind
+		errType  string
+		message  string
+	}{
+		"openai quota": {
+			provider: func(url string) service.Provider { return service.NewOpenAIProvider(url, "test-key", "gpt-test") },
+			status:   http.StatusTooManyRequests,
+			body:     `{"error": {"message": "You exceeded your current quota", "type": "insufficient_quota", "code": "insufficient_quota"}}`,
+			kind:     service.ErrorQuotaExceeded,
+			errType:  "insufficient_quota",
+			message:  "You exceeded your current quota",
+		},
+		"anthropic invalid request": {
+			provider: func(url string) service.Provider { return service.NewAnthropicProvider(url, "test-key", "claude-test") },
+			status:   http.StatusBadRequest,
+			body:     `{"type": "error", "error": {"type": "invalid_request_error", "message": "prompt is too long: 210000 tokens > 200000 maximum"}}`,
+			kind:     service.ErrorContextLength,
+			errType:  "invalid_request_error",
+			message:  "prompt is too long: 210000 tokens > 200000 maximum",
+		},
+		"ollama missing model": {
+			provider: func(url string) service.Provider { return service.NewOllamaProvider(url, "llama-test") },
+			status:   http.StatusNotFound,
+			body:     `{"error": "model \"llama-test\" not found, try pulling it first"}`,
+			kind:     service.ErrorInvalidRequest,
+			message:  `model "llama-test" not found, try pulling it first`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(test.status)
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+
+			// the streaming path fails the same way instead of producing an empty answer
+			_, err := test.provider(server.URL).Stream(context.Background(), []service.Message{{Role: "user", Content: "Hi"}}, models.GenerationParams{})
+
+			var providerErr *service.ProviderError
+			assert.ErrorAs(t, err, &providerErr)
+			assert.Equal(t, test.kind, providerErr.Kind)
+			assert.Equal(t, test.errType, providerErr.Type)
+			assert.Equal(t, test.message, providerErr.Message)
+			assert.Equal(t, int32(1), calls.Load())
+		})
+	}
+}
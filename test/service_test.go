@@ -1,11 +1,17 @@
 package test
 
 import (
+	"context"
 	"errors"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"go-bot/internal/db"
 	"go-bot/internal/models"
+	"go-bot/internal/service"
+	"go-bot/internal/util"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -35,10 +41,6 @@ func (m *MockService) ProcessStream(request models.ChatRequest) (chan string, er
 }
 
 func TestProcessChat(t *testing.T) {
-	// setup mock DB with test URI
-	db.Connect("mongodb://localhost:27017/test-db")
-	defer db.Disconnect()
-
 	// use mock service
 	mockService := &MockService{}
 
@@ -61,10 +63,6 @@ func TestProcessChat(t *testing.T) {
 }
 
 func TestProcessStream(t *testing.T) {
-	// setup mock DB with test URI
-	db.Connect("mongodb://localhost:27017/test-db")
-	defer db.Disconnect()
-
 	// use mock service
 	mockService := &MockService{}
 
@@ -94,3 +92,564 @@ func TestProcessStream(t *testing.T) {
 	assert.Nil(t, streamChannel)
 	assert.Equal(t, "message cannot be empty", err.Error())
 }
+
+func TestBuildMessagesReplaysAssistantTurns(t *testing.T) {
+	history := []models.ChatMessage{
+		{UserID: "test_user", Message: "Hello", Response: "Hi! How can I help?"},
+		{UserID: "test_user", Message: "What's the capital of France?", Response: "Paris."},
+	}
+
+	messages := service.BuildMessages("And of Italy?", history, "You are a helpful assistant.")
+
+	assert.Equal(t, []service.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "Hello"},
+		{Role: "assistant", Content: "Hi! How can I help?"},
+		{Role: "user", Content: "What's the capital of France?"},
+		{Role: "assistant", Content: "Paris."},
+		{Role: "user", Content: "And of Italy?"},
+	}, messages)
+}
+
+func TestBuildMessagesSkipsEmptyResponses(t *testing.T) {
+	history := []models.ChatMessage{
+		{UserID: "test_user", Message: "Hello", Response: ""},
+		{UserID: "test_user", Message: "Are you there?", Response: "Yes."},
+	}
+
+	messages := service.BuildMessages("Great", history, "system")
+
+	assert.Equal(t, []service.Message{
+		{Role: "system", Content: "system"},
+		{Role: "user", Content: "Hello"},
+		{Role: "user", Content: "Are you there?"},
+		{Role: "assistant", Content: "Yes."},
+		{Role: "user", Content: "Great"},
+	}, messages)
+}
+
+func TestServiceProcessChatSavesExchange(t *testing.T) {
+	provider := &FakeProvider{Reply: "Paris"}
+	store := setupService(t, provider)
+
+	request := models.ChatRequest{Message: "What is the capital of France?"}
+	response, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	assert.Equal(t, "Paris", response)
+	assert.NotEmpty(t, request.UserID)
+	assert.NotEmpty(t, request.ConversationID)
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "What is the capital of France?", history[0].Message)
+	assert.Equal(t, "Paris", history[0].Response)
+
+	// the follow-up replays the first exchange
+	followUp := models.ChatRequest{UserID: request.UserID, ConversationID: request.ConversationID, Message: "And Italy?"}
+	_, err = service.ProcessChat(context.Background(), &followUp)
+	assert.NoError(t, err)
+
+	received := provider.Received()
+	assert.Len(t, received, 2)
+	assert.Equal(t, []service.Message{
+		{Role: "system", Content: "You are a helpful assistant."},
+		{Role: "user", Content: "What is the capital of France?"},
+		{Role: "assistant", Content: "Paris"},
+		{Role: "user", Content: "And Italy?"},
+	}, received[1])
+}
+
+func TestServiceProcessChatRejectsForeignConversation(t *testing.T) {
+	store := setupService(t, &FakeProvider{Reply: "Hi"})
+	conversation, err := store.CreateConversation(context.Background(), "owner", "", "Private")
+	assert.NoError(t, err)
+
+	request := models.ChatRequest{UserID: "intruder", ConversationID: conversation.ID.Hex(), Message: "Hello"}
+	_, err = service.ProcessChat(context.Background(), &request)
+	assert.ErrorIs(t, err, db.ErrConversationNotFound)
+}
+
+// drain a stream into its events
+func collectEvents(events <-chan models.StreamEvent) []models.StreamEvent {
+	var collected []models.StreamEvent
+	for event := range events {
+		collected = append(collected, event)
+	}
+	return collected
+}
+
+func eventTypes(events []models.StreamEvent) []string {
+	types := make([]string, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func TestServiceProcessStreamSavesAggregatedResponse(t *testing.T) {
+	store := setupService(t, &FakeProvider{Chunks: []string{"Once upon", " a time", "\n\n"}})
+
+	request := models.ChatRequest{UserID: "test_user", Message: "Tell me a story."}
+	streamChannel, err := service.ProcessStream(context.Background(), &request)
+	assert.NoError(t, err)
+
+	events := collectEvents(streamChannel)
+	assert.Equal(t, []string{"start", "delta", "delta", "delta", "usage", "done"}, eventTypes(events))
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+	assert.Equal(t, "Once upon a time\n\n", history[0].Response)
+	assert.False(t, history[0].Interrupted)
+
+	start := events[0]
+	assert.Equal(t, request.ConversationID, start.ConversationID)
+	assert.Equal(t, history[0].ID.Hex(), start.MessageID)
+	assert.Equal(t, "fake-model", start.Model)
+
+	// deltas carry the raw text, whitespace included
+	for i, text := range []string{"Once upon", " a time", "\n\n"} {
+		if assert.NotNil(t, events[i+1].Index) {
+			assert.Equal(t, i, *events[i+1].Index)
+		}
+		assert.Equal(t, text, events[i+1].Text)
+	}
+
+	usage := events[4].Usage
+	assert.NotNil(t, usage)
+	assert.Positive(t, usage.PromptTokens)
+	assert.Positive(t, usage.CompletionTokens)
+	assert.Equal(t, usage.PromptTokens+usage.CompletionTokens, usage.TotalTokens)
+	assert.Equal(t, "stop", events[5].FinishReason)
+}
+
+func TestServiceProcessStreamProviderError(t *testing.T) {
+	store := setupService(t, &FakeProvider{Chunks: []string{"Once"}, StreamErr: &service.ProviderError{Provider: "fake", Kind: service.ErrorRateLimited}})
+
+	request := models.ChatRequest{UserID: "test_user", Message: "Tell me a story."}
+	streamChannel, err := service.ProcessStream(context.Background(), &request)
+	assert.NoError(t, err)
+
+	events := collectEvents(streamChannel)
+	assert.Equal(t, []string{"start", "delta", "usage", "error", "done"}, eventTypes(events))
+	assert.Equal(t, "rate_limited", events[3].Code)
+	assert.NotEmpty(t, events[3].Error)
+	assert.Equal(t, "error", events[4].FinishReason)
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "Once", history[0].Response)
+	assert.True(t, history[0].Interrupted)
+}
+
+func TestServiceProcessStreamClientDisconnect(t *testing.T) {
+	// the provider never finishes on its own, only the client leaving ends the answer
+	store := setupService(t, &FakeProvider{Chunks: []string{"Once", " upon", " a", " time"}, Hold: make(chan struct{})})
+	// give up on the answer as soon as the client leaves
+	service.ConfigureStreamResume(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := models.ChatRequest{UserID: "test_user", Message: "Tell me a story."}
+	streamChannel, err := service.ProcessStream(ctx, &request)
+	assert.NoError(t, err)
+
+	// read the first chunk, then go away like a closed browser tab
+	assert.Equal(t, "start", (<-streamChannel).Type)
+	assert.Equal(t, "Once", (<-streamChannel).Text)
+	cancel()
+
+	var history []models.ChatMessage
+	assert.Eventually(t, func() bool {
+		history, _ = store.GetChatHistory(context.Background(), request.ConversationID, 10)
+		return len(history) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.True(t, history[0].Interrupted)
+	assert.True(t, strings.HasPrefix(history[0].Response, "Once"))
+
+	// the stream is closed once the partial response is saved
+	for range streamChannel {
+	}
+}
+
+func TestServiceResumeStreamAfterDisconnect(t *testing.T) {
+	provider := &FakeProvider{Chunks: []string{"Once", " upon", " a", " time"}}
+	store := setupService(t, provider)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	request := models.ChatRequest{UserID: "test_user", Message: "Tell me a story."}
+	streamChannel, err := service.ProcessStream(ctx, &request)
+	assert.NoError(t, err)
+
+	start := <-streamChannel
+	first := <-streamChannel
+	assert.Equal(t, "Once", first.Text)
+	cancel()
+	for range streamChannel {
+	}
+
+	// generation carries on within the resume window, a reconnect picks up after the last event seen
+	resumed, err := service.ResumeStream(context.Background(), "test_user", start.MessageID, first.ID)
+	assert.NoError(t, err)
+
+	var text strings.Builder
+	lastID := first.ID
+	for event := range resumed {
+		assert.Equal(t, lastID+1, event.ID)
+		lastID = event.ID
+		text.WriteString(event.Text)
+	}
+	assert.Equal(t, " upon a time", text.String())
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "Once upon a time", history[0].Response)
+	assert.False(t, history[0].Interrupted)
+
+	_, err = service.ResumeStream(context.Background(), "someone_else", start.MessageID, 0)
+	assert.ErrorIs(t, err, service.ErrStreamNotFound)
+}
+
+func TestServiceStreamsAreLimitedToTheirAPIKey(t *testing.T) {
+	setupService(t, &FakeProvider{Chunks: []string{"Once", " upon", " a", " time"}, Hold: make(chan struct{})})
+
+	ctx, cancel := context.WithCancel(testAPIKeyContext())
+	defer cancel()
+	request := models.ChatRequest{UserID: "test_user", Message: "Tell me a story."}
+	streamChannel, err := service.ProcessStream(ctx, &request)
+	assert.NoError(t, err)
+	start := <-streamChannel
+
+	// the user ID is the client's to choose, another key naming the same user cannot follow or stop the answer
+	otherKey := util.WithAPIKeyID(context.Background(), "key_other")
+	_, err = service.ResumeStream(otherKey, "test_user", start.MessageID, 0)
+	assert.ErrorIs(t, err, service.ErrStreamNotFound)
+	assert.ErrorIs(t, service.CancelStream(otherKey, "test_user", start.MessageID), service.ErrStreamNotFound)
+
+	assert.NoError(t, service.CancelStream(testAPIKeyContext(), "test_user", start.MessageID))
+	var last models.StreamEvent
+	for event := range streamChannel {
+		last = event
+	}
+	assert.Equal(t, "cancelled", last.FinishReason)
+}
+
+func TestServiceProcessChatFallsBackToNextProvider(t *testing.T) {
+	primary := &FakeProvider{Label: "primary", Err: &service.ProviderError{Provider: "primary", Kind: service.ErrorServer}}
+	backup := &FakeProvider{Label: "backup", Reply: "Paris"}
+	store := setupService(t, nil)
+	service.SetProviders(primary, backup)
+
+	request := models.ChatRequest{Message: "What is the capital of France?"}
+	response, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	assert.Equal(t, "Paris", response)
+	assert.Len(t, primary.Received(), 1)
+	assert.Equal(t, primary.Received(), backup.Received())
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "backup", history[0].Provider)
+	assert.Equal(t, "fake-model", history[0].Model)
+}
+
+func TestServiceProcessChatKeepsRejectedRequestsOnProvider(t *testing.T) {
+	primary := &FakeProvider{Label: "primary", Err: &service.ProviderError{Provider: "primary", Kind: service.ErrorContextLength}}
+	backup := &FakeProvider{Label: "backup", Reply: "Paris"}
+	setupService(t, nil)
+	service.SetProviders(primary, backup)
+
+	request := models.ChatRequest{Message: "What is the capital of France?"}
+	_, err := service.ProcessChat(context.Background(), &request)
+
+	var providerErr *service.ProviderError
+	assert.ErrorAs(t, err, &providerErr)
+	assert.Equal(t, service.ErrorContextLength, providerErr.Kind)
+	assert.Empty(t, backup.Received())
+}
+
+func TestServiceProcessStreamFallsBackToNextProvider(t *testing.T) {
+	primary := &FakeProvider{Label: "primary", Err: &service.ProviderError{Provider: "primary", Kind: service.ErrorRateLimited}}
+	backup := &FakeProvider{Label: "backup", Chunks: []string{"Once upon", " a time"}}
+	store := setupService(t, nil)
+	service.SetProviders(primary, backup)
+
+	request := models.ChatRequest{UserID: "test_user", Message: "Tell me a story."}
+	streamChannel, err := service.ProcessStream(context.Background(), &request)
+	assert.NoError(t, err)
+
+	events := collectEvents(streamChannel)
+	assert.Equal(t, []string{"start", "delta", "delta", "usage", "done"}, eventTypes(events))
+	assert.Equal(t, "backup", events[0].Provider)
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "Once upon a time", history[0].Response)
+	assert.Equal(t, "backup", history[0].Provider)
+}
+
+func TestServiceProcessChatPassesGenerationParams(t *testing.T) {
+	provider := &FakeProvider{Reply: "Paris"}
+	store := setupService(t, provider)
+
+	temperature, maxTokens, seed := 0.2, 100, int64(7)
+	params := models.GenerationParams{Temperature: &temperature, MaxTokens: &maxTokens, Stop: models.StopSequences{"\n"}, Seed: &seed}
+	request := models.ChatRequest{Message: "What is the capital of France?", GenerationParams: params}
+	_, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.GenerationParams{params}, provider.ReceivedParams())
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, &params, history[0].Parameters)
+
+	// without parameters nothing is stored
+	followUp := models.ChatRequest{UserID: request.UserID, ConversationID: request.ConversationID, Message: "And Italy?"}
+	_, err = service.ProcessChat(context.Background(), &followUp)
+	assert.NoError(t, err)
+	history, err = store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Nil(t, history[1].Parameters)
+}
+
+func TestServiceRejectsInvalidGenerationParams(t *testing.T) {
+	provider := &FakeProvider{Reply: "Paris"}
+	setupService(t, provider)
+
+	tooHot, negative, tooMany := 2.5, -0.1, 1_000_000
+	for name, request := range map[string]models.ChatRequest{
+		"temperature":   {GenerationParams: models.GenerationParams{Temperature: &tooHot}},
+		"top_p":         {GenerationParams: models.GenerationParams{TopP: &negative}},
+		"max_tokens":    {GenerationParams: models.GenerationParams{MaxTokens: &tooMany}},
+		"stop":          {GenerationParams: models.GenerationParams{Stop: models.StopSequences{"a", "b", "c", "d", "e"}}},
+		"unknown model": {Model: "gpt-unknown"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request.Message = "Hello"
+			_, err := service.ProcessChat(context.Background(), &request)
+			assert.ErrorIs(t, err, service.ErrInvalidParameters)
+		})
+	}
+	assert.Empty(t, provider.Received())
+}
+
+func TestServiceProcessChatUsesRequestedModel(t *testing.T) {
+	primary := &FakeProvider{Label: "primary", Reply: "From primary"}
+	small := &FakeProvider{Label: "primary", ModelName: "small-model", Reply: "From small"}
+	store := setupService(t, primary)
+	service.AllowModels(small)
+
+	request := models.ChatRequest{Message: "Hello", Model: "small-model"}
+	response, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	assert.Equal(t, "From small", response)
+	assert.Empty(t, primary.Received())
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "small-model", history[0].Model)
+
+	// the models of the fallback chain can be asked for too
+	request = models.ChatRequest{Message: "Hello", Model: "fake-model"}
+	response, err = service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	assert.Equal(t, "From primary", response)
+}
+
+func TestServiceStoresReportedUsage(t *testing.T) {
+	reported := &models.Usage{PromptTokens: 120, CompletionTokens: 30, TotalTokens: 150}
+	store := setupService(t, &FakeProvider{Reply: "Paris", Chunks: []string{"Par", "is"}, Usage: reported})
+
+	request := models.ChatRequest{UserID: "test_user", Message: "What is the capital of France?"}
+	_, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+
+	streamRequest := models.ChatRequest{UserID: "test_user", ConversationID: request.ConversationID, Message: "Again?"}
+	streamChannel, err := service.ProcessStream(context.Background(), &streamRequest)
+	assert.NoError(t, err)
+	events := collectEvents(streamChannel)
+	assert.Equal(t, reported, events[3].Usage)
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	assert.Equal(t, *reported, history[0].Usage)
+	assert.Equal(t, *reported, history[1].Usage)
+}
+
+func TestServiceEstimatesUnreportedUsage(t *testing.T) {
+	store := setupService(t, &FakeProvider{Reply: "Paris"})
+
+	request := models.ChatRequest{UserID: "test_user", Message: "What is the capital of France?"}
+	_, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	usage := history[0].Usage
+	assert.Positive(t, usage.PromptTokens)
+	assert.Positive(t, usage.CompletionTokens)
+	assert.Equal(t, usage.PromptTokens+usage.CompletionTokens, usage.TotalTokens)
+}
+
+func TestServiceStoresExchangeCost(t *testing.T) {
+	usage := &models.Usage{PromptTokens: 1000, CompletionTokens: 500, TotalTokens: 1500}
+	store := setupService(t, &FakeProvider{Reply: "Paris", Chunks: []string{"Paris"}, ModelName: "gpt-4o-2024-08-06", Usage: usage})
+
+	request := models.ChatRequest{UserID: "test_user", Message: "What is the capital of France?"}
+	_, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+
+	streamRequest := models.ChatRequest{UserID: "test_user", ConversationID: request.ConversationID, Message: "Again?"}
+	streamChannel, err := service.ProcessStream(context.Background(), &streamRequest)
+	assert.NoError(t, err)
+	collectEvents(streamChannel)
+
+	// dated versions are billed at the price of their model, $2.50 and $10 per million tokens for gpt-4o
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Len(t, history, 2)
+	for _, chat := range history {
+		assert.InDelta(t, 0.0075, chat.Cost, 1e-9)
+	}
+}
+
+func TestServiceUnpricedModelsCostNothing(t *testing.T) {
+	store := setupService(t, &FakeProvider{Reply: "Paris", ModelName: "llama3.1"})
+
+	request := models.ChatRequest{UserID: "test_user", Message: "What is the capital of France?"}
+	_, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	assert.Zero(t, history[0].Cost)
+}
+
+func TestServiceEnforcesUserQuota(t *testing.T) {
+	setupService(t, &FakeProvider{Reply: "Paris", Usage: &models.Usage{PromptTokens: 60, CompletionTokens: 30, TotalTokens: 90}})
+	service.ConfigureQuotas(models.QuotaLimits{DailyTokens: 100, MonthlyTokens: 1000}, models.QuotaLimits{}, 80)
+
+	request := models.ChatRequest{UserID: "quota_user", Message: "What is the capital of France?"}
+	_, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	if assert.NotNil(t, request.Quota) {
+		assert.Equal(t, models.QuotaPeriodDaily, request.Quota.Period)
+		assert.Equal(t, float64(100), request.Quota.Remaining())
+		assert.False(t, request.Quota.Warning)
+	}
+
+	// the answer crossing the soft limit is still given, with a warning
+	request = models.ChatRequest{UserID: "quota_user", ConversationID: request.ConversationID, Message: "Again?"}
+	_, err = service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	assert.True(t, request.Quota.Warning)
+
+	// once used up, the provider is not asked anymore
+	request = models.ChatRequest{UserID: "quota_user", ConversationID: request.ConversationID, Message: "Once more?"}
+	_, err = service.ProcessChat(context.Background(), &request)
+	var quotaErr *service.QuotaExceededError
+	if assert.ErrorAs(t, err, &quotaErr) {
+		assert.Equal(t, models.UsageGroupUser, quotaErr.Status.Scope)
+		assert.Equal(t, models.QuotaPeriodDaily, quotaErr.Status.Period)
+		assert.Zero(t, quotaErr.Status.Remaining())
+	}
+	_, err = service.ProcessStream(context.Background(), &models.ChatRequest{UserID: "quota_user", Message: "Stream it?"})
+	assert.ErrorAs(t, err, &quotaErr)
+
+	// other users have quotas of their own
+	_, err = service.ProcessChat(context.Background(), &models.ChatRequest{UserID: "other_user", Message: "Hello"})
+	assert.NoError(t, err)
+}
+
+func TestServiceRequiresUserUnderUserQuota(t *testing.T) {
+	provider := &FakeProvider{Reply: "Paris"}
+	setupService(t, provider)
+
+	// without user quotas a user is generated
+	request := models.ChatRequest{Message: "Hello"}
+	_, err := service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, request.UserID)
+
+	// with them a generated user would dodge the quota, so a user must be named
+	service.ConfigureQuotas(models.QuotaLimits{DailyTokens: 100}, models.QuotaLimits{}, 80)
+	for _, process := range []func(*models.ChatRequest) error{
+		func(request *models.ChatRequest) error {
+			_, err := service.ProcessChat(context.Background(), request)
+			return err
+		},
+		func(request *models.ChatRequest) error {
+			_, err := service.ProcessStream(context.Background(), request)
+			return err
+		},
+		func(request *models.ChatRequest) error {
+			_, err := service.ProcessCompletion(context.Background(), request, []service.Message{{Role: "user", Content: "Hello"}})
+			return err
+		},
+	} {
+		request := models.ChatRequest{Message: "Hello"}
+		assert.ErrorIs(t, process(&request), service.ErrUserRequired)
+		assert.Empty(t, request.ConversationID)
+	}
+	// neither the provider nor the store were reached
+	assert.Len(t, provider.Received(), 1)
+}
+
+// answers like FakeProvider, then cancels the request as a client disconnecting at that point would
+type disconnectingProvider struct {
+	*FakeProvider
+	cancel context.CancelFunc
+}
+
+func (p *disconnectingProvider) Complete(ctx context.Context, messages []service.Message, params models.GenerationParams) (*service.Completion, error) {
+	completion, err := p.FakeProvider.Complete(ctx, messages, params)
+	p.cancel()
+	return completion, err
+}
+
+func TestServiceProcessChatSavesAnswerAfterClientDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	setupService(t, &disconnectingProvider{FakeProvider: &FakeProvider{Reply: "Paris"}, cancel: cancel})
+	// the SQL store, unlike the in-memory one, gives up on cancelled contexts
+	store, err := db.NewSQLiteStore(filepath.Join(t.TempDir(), "chat.db"))
+	assert.NoError(t, err)
+	service.SetStore(store)
+
+	request := models.ChatRequest{Message: "What is the capital of France?"}
+	_, err = service.ProcessChat(ctx, &request)
+	assert.NoError(t, err)
+	assert.Error(t, ctx.Err())
+
+	history, err := store.GetChatHistory(context.Background(), request.ConversationID, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "Paris", history[0].Response)
+		assert.NotZero(t, history[0].Usage.TotalTokens)
+	}
+}
+
+func TestServiceProcessChatReservesMaxTokens(t *testing.T) {
+	provider := &FakeProvider{Reply: "Hi"}
+	store := setupService(t, provider)
+	conversation, err := store.CreateConversation(context.Background(), "test_user", "", "Long")
+	assert.NoError(t, err)
+	long := strings.Repeat(" word", 750)
+	for _, prefix := range []string{"oldest", "older", "newer", "newest"} {
+		assert.NoError(t, store.SaveChat(context.Background(), models.ChatMessage{UserID: "test_user", ConversationID: conversation.ID.Hex(), Message: prefix + long, Response: prefix + long}))
+	}
+
+	// the requested answer length is kept free, so older exchanges are left out
+	maxTokens := 4096
+	request := models.ChatRequest{UserID: "test_user", ConversationID: conversation.ID.Hex(), Message: "Go on",
+		GenerationParams: models.GenerationParams{MaxTokens: &maxTokens}}
+	_, err = service.ProcessChat(context.Background(), &request)
+	assert.NoError(t, err)
+
+	received := provider.Received()
+	if assert.Len(t, received, 1) && assert.Len(t, received[0], 6) {
+		assert.True(t, strings.HasPrefix(received[0][1].Content, "newer"))
+	}
+}
@@ -0,0 +1,254 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go-bot/internal/api"
+	"go-bot/internal/models"
+	"go-bot/internal/service"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// start a test server and return the URL of its WebSocket chat endpoint
+func startWebSocketServer(t *testing.T, provider *FakeProvider) string {
+	server := httptest.NewServer(setupRouter(t, provider))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { api.ConfigureWebSocket(nil, api.DefaultWebSocketPingInterval) })
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?user_id=123"
+}
+
+// open a WebSocket connection to the chat endpoint of a test server
+func dialWebSocket(t *testing.T, provider *FakeProvider) *websocket.Conn {
+	header := http.Header{}
+	header.Set("X-API-KEY", testAPIKey)
+	conn, _, err := websocket.DefaultDialer.Dial(startWebSocketServer(t, provider), header)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// read frames until one of the given type arrives, returning every frame read
+func readUntil(t *testing.T, conn *websocket.Conn, frameType string) []models.StreamEvent {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var frames []models.StreamEvent
+	for {
+		var frame models.StreamEvent
+		if !assert.NoError(t, conn.ReadJSON(&frame)) {
+			return frames
+		}
+		frames = append(frames, frame)
+		if frame.Type == frameType {
+			return frames
+		}
+	}
+}
+
+func TestWebSocketChat(t *testing.T) {
+	conn := dialWebSocket(t, &FakeProvider{Chunks: []string{"Hello", " there"}})
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "ping"}))
+	assert.Equal(t, "pong", readUntil(t, conn, "pong")[0].Type)
+
+	// several messages go over the same connection and stay in one conversation
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "Hi"}))
+	frames := readUntil(t, conn, "done")
+	assert.Equal(t, []string{"start", "delta", "delta", "usage", "done"}, eventTypes(frames))
+	assert.Equal(t, "123", frames[0].UserID)
+	conversationID := frames[0].ConversationID
+	assert.NotEmpty(t, conversationID)
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "Again"}))
+	frames = readUntil(t, conn, "done")
+	assert.Equal(t, conversationID, frames[0].ConversationID)
+
+	// switching to a conversation the user does not own fails, an empty ID starts a new one
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "switch_conversation", ConversationID: "65a1f0c2e4b0a1b2c3d4e5f6"}))
+	assert.Equal(t, "Conversation not found", readUntil(t, conn, "error")[0].Error)
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "switch_conversation"}))
+	assert.Equal(t, "conversation", readUntil(t, conn, "conversation")[0].Type)
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "Fresh start"}))
+	frames = readUntil(t, conn, "done")
+	assert.NotEqual(t, conversationID, frames[0].ConversationID)
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "dance"}))
+	assert.Equal(t, "Unknown frame type", readUntil(t, conn, "error")[0].Error)
+}
+
+func TestWebSocketCancel(t *testing.T) {
+	conn := dialWebSocket(t, &FakeProvider{Chunks: []string{"Once"}, Hold: make(chan struct{})})
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "Tell me a story."}))
+	readUntil(t, conn, "delta")
+
+	// only one answer is generated at a time
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "And another"}))
+	assert.Equal(t, "An answer is already being generated", readUntil(t, conn, "error")[0].Error)
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "cancel"}))
+	frames := readUntil(t, conn, "done")
+	assert.Equal(t, "cancelled", frames[len(frames)-1].FinishReason)
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "cancel"}))
+	assert.Equal(t, "Nothing to cancel", readUntil(t, conn, "error")[0].Error)
+}
+
+func TestWebSocketCancelBeforeProviderAnswers(t *testing.T) {
+	accept := make(chan struct{})
+	conn := dialWebSocket(t, &FakeProvider{Chunks: []string{"Once"}, Accept: accept, Hold: make(chan struct{})})
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "Tell me a story."}))
+
+	// frames are still read while the provider is being reached
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "ping"}))
+	assert.Equal(t, []string{"pong"}, eventTypes(readUntil(t, conn, "pong")))
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "And another"}))
+	assert.Equal(t, "An answer is already being generated", readUntil(t, conn, "error")[0].Error)
+
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "cancel"}))
+	// the cancel frame has been handled once its pong arrives
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "ping"}))
+	assert.Equal(t, []string{"pong"}, eventTypes(readUntil(t, conn, "pong")))
+
+	close(accept)
+	frames := readUntil(t, conn, "done")
+	assert.Equal(t, "start", frames[0].Type)
+	assert.Equal(t, "cancelled", frames[len(frames)-1].FinishReason)
+}
+
+func TestWebSocketChecksOrigin(t *testing.T) {
+	endpoint := startWebSocketServer(t, &FakeProvider{Reply: "Hi"})
+
+	dial := func(origin string) (*http.Response, error) {
+		header := http.Header{}
+		header.Set("X-API-KEY", testAPIKey)
+		header.Set("Origin", origin)
+		conn, response, err := websocket.DefaultDialer.Dial(endpoint, header)
+		if err == nil {
+			conn.Close()
+		}
+		return response, err
+	}
+
+	// pages of other sites cannot connect
+	response, err := dial("https://evil.example")
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, http.StatusForbidden, response.StatusCode)
+	}
+
+	// the server's own pages can
+	_, err = dial("http" + strings.TrimPrefix(strings.TrimSuffix(endpoint, "/ws?user_id=123"), "ws"))
+	assert.NoError(t, err)
+
+	api.ConfigureWebSocket([]string{"https://chat.example/"}, 0)
+	_, err = dial("https://chat.example")
+	assert.NoError(t, err)
+	_, err = dial("https://evil.example")
+	assert.Error(t, err)
+
+	api.ConfigureWebSocket([]string{"*"}, 0)
+	_, err = dial("https://evil.example")
+	assert.NoError(t, err)
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	endpoint := startWebSocketServer(t, &FakeProvider{Reply: "Hi"})
+	api.ConfigureWebSocket(nil, 50*time.Millisecond)
+
+	header := http.Header{}
+	header.Set("X-API-KEY", testAPIKey)
+	live, _, err := websocket.DefaultDialer.Dial(endpoint, header)
+	assert.NoError(t, err)
+	defer live.Close()
+	dead, _, err := websocket.DefaultDialer.Dial(endpoint, header)
+	assert.NoError(t, err)
+	defer dead.Close()
+
+	// a client reading its connection answers the server's pings
+	frames := make(chan models.StreamEvent)
+	go func() {
+		defer close(frames)
+		for {
+			var frame models.StreamEvent
+			if live.ReadJSON(&frame) != nil {
+				return
+			}
+			frames <- frame
+		}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+
+	assert.NoError(t, live.WriteJSON(models.WSClientFrame{Type: "ping"}))
+	select {
+	case frame, ok := <-frames:
+		assert.True(t, ok, "live connection closed")
+		assert.Equal(t, "pong", frame.Type)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no pong on the live connection")
+	}
+
+	// one that left its pings unanswered has been closed
+	dead.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame models.StreamEvent
+	err = dead.ReadJSON(&frame)
+	assert.Error(t, err)
+	var netErr interface{ Timeout() bool }
+	if errors.As(err, &netErr) {
+		assert.False(t, netErr.Timeout(), "dead connection left open")
+	}
+}
+
+// issue a stream ticket the way a browser page would before connecting
+func issueStreamTicket(t *testing.T, router http.Handler) string {
+	req := httptest.NewRequest("POST", "/stream/tickets", nil)
+	req.Header.Set("X-API-KEY", testAPIKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var issued struct {
+		Ticket    string    `json:"ticket"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &issued))
+	assert.WithinDuration(t, time.Now().Add(service.StreamTicketLifetime), issued.ExpiresAt, 5*time.Second)
+	return issued.Ticket
+}
+
+func TestWebSocketStreamTicket(t *testing.T) {
+	router := setupRouter(t, &FakeProvider{Chunks: []string{"Hello"}})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	endpoint := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?user_id=123&ticket="
+
+	// no header is sent, like a browser's WebSocket
+	ticket := issueStreamTicket(t, router)
+	conn, _, err := websocket.DefaultDialer.Dial(endpoint+ticket, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	assert.NoError(t, conn.WriteJSON(models.WSClientFrame{Type: "message", Message: "Hi"}))
+	assert.Equal(t, []string{"start", "delta", "usage", "done"}, eventTypes(readUntil(t, conn, "done")))
+
+	// tickets are single use
+	_, response, err := websocket.DefaultDialer.Dial(endpoint+ticket, nil)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+	}
+	_, _, err = websocket.DefaultDialer.Dial(endpoint+"gbt_unknown", nil)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+}